@@ -0,0 +1,163 @@
+package simian
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// AttributeFilter decides from an entry's attributes whether the entry may be
+// among the results of a search. Use MatchingAttributes to apply filters.
+type AttributeFilter func(attributes map[string]interface{}) bool
+
+// AttributeEquals matches entries whose named attribute equals the given
+// value. Numbers compare equal regardless of their type, so that an int added
+// to the index matches the float64 or json.Number it becomes once stored as
+// JSON.
+func AttributeEquals(name string, value interface{}) AttributeFilter {
+	return func(attributes map[string]interface{}) bool {
+		actual, ok := attributes[name]
+		return ok && attributeValuesEqual(actual, value)
+	}
+}
+
+// AttributeExists matches entries which have the named attribute.
+func AttributeExists(name string) AttributeFilter {
+	return func(attributes map[string]interface{}) bool {
+		_, ok := attributes[name]
+		return ok
+	}
+}
+
+// AttributeIn matches entries whose named attribute equals any of the given
+// values.
+func AttributeIn(name string, values ...interface{}) AttributeFilter {
+	return func(attributes map[string]interface{}) bool {
+		actual, ok := attributes[name]
+		if !ok {
+			return false
+		}
+		for _, value := range values {
+			if attributeValuesEqual(actual, value) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// AttributeInRange matches entries whose named attribute is a number between
+// min and max inclusive.
+func AttributeInRange(name string, min, max float64) AttributeFilter {
+	return func(attributes map[string]interface{}) bool {
+		actual, ok := attributeNumber(attributes[name])
+		return ok && actual >= min && actual <= max
+	}
+}
+
+// AttributeMatches matches entries for which the given predicate returns true,
+// for conditions the declarative filters can't express.
+func AttributeMatches(predicate func(attributes map[string]interface{}) bool) AttributeFilter {
+	return AttributeFilter(predicate)
+}
+
+func attributeNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// attributeNumberText returns the exact decimal form of a number, formatted as
+// JSON would format a float64 with the same value. Comparing these instead of
+// float64s keeps large integers distinct.
+func attributeNumberText(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case int:
+		return strconv.FormatInt(int64(v), 10), true
+	case int8:
+		return strconv.FormatInt(int64(v), 10), true
+	case int16:
+		return strconv.FormatInt(int64(v), 10), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float32:
+		return floatText(float64(v))
+	case float64:
+		return floatText(v)
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return strconv.FormatInt(i, 10), true
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return strconv.FormatUint(u, 10), true
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", false
+		}
+		return floatText(f)
+	}
+	return "", false
+}
+
+func attributeValuesEqual(a, b interface{}) bool {
+	aText, aIsNumber := attributeNumberText(a)
+	bText, bIsNumber := attributeNumberText(b)
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber && aText == bText
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func floatText(f float64) (string, bool) {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return strconv.FormatInt(int64(f), 10), true
+	}
+
+	textBytes, err := json.Marshal(f)
+	if err != nil {
+		return "", false
+	}
+
+	return string(textBytes), true
+}
@@ -0,0 +1,47 @@
+package simian
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAttributeFilter(t *testing.T) {
+	attributes := map[string]interface{}{
+		"id":    json.Number("1152921504606846977"),
+		"owner": "alice",
+		"score": 5.0,
+		"tags":  []interface{}{"cat", "dog"},
+	}
+
+	cases := []struct {
+		name     string
+		filter   AttributeFilter
+		expected bool
+	}{
+		{"equals matching string", AttributeEquals("owner", "alice"), true},
+		{"equals other string", AttributeEquals("owner", "bob"), false},
+		{"equals missing attribute", AttributeEquals("missing", "alice"), false},
+		{"equals number of another type", AttributeEquals("score", 5), true},
+		{"equals number against string", AttributeEquals("score", "5"), false},
+		{"equals large integer", AttributeEquals("id", int64(1<<60+1)), true},
+		{"equals nearby large integer", AttributeEquals("id", int64(1<<60)), false},
+		{"equals structured value", AttributeEquals("tags", []interface{}{"cat", "dog"}), true},
+		{"in with a matching value", AttributeIn("owner", "bob", "alice"), true},
+		{"in without a matching value", AttributeIn("owner", "bob", "carol"), false},
+		{"in for a missing attribute", AttributeIn("missing", nil), false},
+		{"in range", AttributeInRange("score", 1, 5), true},
+		{"outside range", AttributeInRange("score", 6, 10), false},
+		{"range of a non-number", AttributeInRange("owner", 0, 10), false},
+		{"exists", AttributeExists("owner"), true},
+		{"exists for a missing attribute", AttributeExists("missing"), false},
+		{"predicate", AttributeMatches(func(a map[string]interface{}) bool { return len(a) == 4 }), true},
+	}
+
+	for _, c := range cases {
+		t.Run("should handle "+c.name, func(t *testing.T) {
+			if result := c.filter(attributes); result != c.expected {
+				t.Errorf("Expected %v but got %v", c.expected, result)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package simian
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/mandykoh/keva"
+)
+
+const attributeIndexDir = "attributes"
+const indexedAttributesFileName = "attributes.json"
+
+// The keys of entries with the same attribute value are split into shards by
+// this many leading characters, so that adding or removing one only rewrites
+// its own shard.
+const attributeShardLength = 2
+
+// attributeIndex maps the values of selected attributes to the keys of the
+// entries which have them, so that entries can be found by attribute without
+// walking every node.
+//
+// Each attribute value is stored with the sorted list of shards it has keys
+// in, and each of those shards with its sorted list of keys.
+type attributeIndex struct {
+	rootPath string
+	keys     *keva.Store
+
+	// Attributes are kept up to date while being built, but can't be queried
+	// until every existing entry has been indexed. Maps names to whether they
+	// have been built.
+	names map[string]bool
+
+	// Guards the names, and makes updating a set of keys atomic.
+	mutex sync.Mutex
+}
+
+// add records the entry's indexed attributes.
+func (a *attributeIndex) add(key string, attributes map[string]interface{}) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for name, value := range attributes {
+		if _, maintained := a.names[name]; !maintained {
+			continue
+		}
+
+		err := a.updateKeys(name, value, key, func(keys []string) []string {
+			i := sort.SearchStrings(keys, key)
+			if i < len(keys) && keys[i] == key {
+				return keys
+			}
+			keys = append(keys, "")
+			copy(keys[i+1:], keys[i:])
+			keys[i] = key
+			return keys
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *attributeIndex) close() error {
+	return closeKevaStore(a.keys)
+}
+
+// finishBuilding marks the given attributes as built, once every existing
+// entry has been indexed.
+func (a *attributeIndex) finishBuilding(names []string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, name := range names {
+		a.names[name] = true
+	}
+
+	return a.saveNames()
+}
+
+// has returns whether the named attribute has been built and can be queried.
+func (a *attributeIndex) has(name string) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.names[name]
+}
+
+// keysWithValue returns the keys of entries whose named attribute has the
+// given value, in sorted order.
+func (a *attributeIndex) keysWithValue(name string, value interface{}) ([]string, error) {
+	indexKey, err := attributeIndexKey(name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	shards, err := a.sortedStrings(indexKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shards are prefixes of the keys in them, so keys in sorted shards are
+	// also sorted
+	var keys []string
+	for _, shard := range shards {
+		shardKeys, err := a.sortedStrings(attributeShardKey(indexKey, shard))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+
+	return keys, nil
+}
+
+// remove forgets the entry's indexed attributes.
+func (a *attributeIndex) remove(key string, attributes map[string]interface{}) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for name, value := range attributes {
+		if _, maintained := a.names[name]; !maintained {
+			continue
+		}
+
+		err := a.updateKeys(name, value, key, func(keys []string) []string {
+			i := sort.SearchStrings(keys, key)
+			if i < len(keys) && keys[i] == key {
+				keys = append(keys[:i], keys[i+1:]...)
+			}
+			return keys
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveNames writes the names of the attributes and whether they have been
+// built. The mutex must be held.
+func (a *attributeIndex) saveNames() error {
+	var names attributeNamesJSON
+	for name, built := range a.names {
+		if built {
+			names.Indexed = append(names.Indexed, name)
+		} else {
+			names.Building = append(names.Building, name)
+		}
+	}
+	sort.Strings(names.Indexed)
+	sort.Strings(names.Building)
+
+	namesBytes, err := json.Marshal(&names)
+	if err != nil {
+		return err
+	}
+
+	return storeFailure(ioutil.WriteFile(path.Join(a.rootPath, indexedAttributesFileName), namesBytes, 0600))
+}
+
+// sortedNames returns the names of the attributes which have been built, in
+// sorted order.
+func (a *attributeIndex) sortedNames() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var names []string
+	for name, built := range a.names {
+		if built {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// sortedStrings reads a sorted list, returning nil if there isn't one. The
+// mutex must be held.
+func (a *attributeIndex) sortedStrings(indexKey string) ([]string, error) {
+	var values []string
+	err := getKevaValue(a.keys, indexKey, &values)
+	if err == keva.ErrValueNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, storeFailure(err)
+	}
+
+	return values, nil
+}
+
+// startBuilding starts maintaining the given attributes, returning every
+// attribute which still needs existing entries to be indexed. This includes
+// any whose building was interrupted.
+func (a *attributeIndex) startBuilding(names []string) ([]string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	added := false
+	for _, name := range names {
+		if _, maintained := a.names[name]; !maintained {
+			a.names[name] = false
+			added = true
+		}
+	}
+
+	if added {
+		err := a.saveNames()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var building []string
+	for name, built := range a.names {
+		if !built {
+			building = append(building, name)
+		}
+	}
+	sort.Strings(building)
+
+	return building, nil
+}
+
+// updateKeys replaces the keys in the given key's shard of entries with the
+// given attribute value with those returned by update. The mutex must be
+// held.
+func (a *attributeIndex) updateKeys(name string, value interface{}, key string, update func([]string) []string) error {
+	indexKey, err := attributeIndexKey(name, value)
+	if err != nil {
+		return err
+	}
+
+	shard := key
+	if len(shard) > attributeShardLength {
+		shard = shard[:attributeShardLength]
+	}
+	shardKey := attributeShardKey(indexKey, shard)
+
+	keys, err := a.sortedStrings(shardKey)
+	if err != nil {
+		return err
+	}
+
+	wasEmpty := len(keys) == 0
+	keys = update(keys)
+
+	if len(keys) == 0 {
+		if wasEmpty {
+			return nil
+		}
+		err = a.keys.Remove(shardKey)
+	} else {
+		err = a.keys.Put(shardKey, keys)
+	}
+	if err != nil {
+		return storeFailure(err)
+	}
+
+	// The list of shards only changes when one becomes empty or non-empty
+	if wasEmpty == (len(keys) == 0) {
+		return nil
+	}
+
+	shards, err := a.sortedStrings(indexKey)
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchStrings(shards, shard)
+	if wasEmpty {
+		shards = append(shards, "")
+		copy(shards[i+1:], shards[i:])
+		shards[i] = shard
+	} else if i < len(shards) && shards[i] == shard {
+		shards = append(shards[:i], shards[i+1:]...)
+	}
+
+	if len(shards) == 0 {
+		return storeFailure(a.keys.Remove(indexKey))
+	}
+	return storeFailure(a.keys.Put(indexKey, shards))
+}
+
+// attributeIndexKey identifies an attribute value in the index. Numbers are
+// identified by their exact value regardless of type, as they would be once
+// stored as JSON.
+func attributeIndexKey(name string, value interface{}) (string, error) {
+	if text, ok := attributeNumberText(value); ok {
+		value = json.Number(text)
+	}
+
+	keyBytes, err := json.Marshal([]interface{}{name, value})
+	if err != nil {
+		return "", err
+	}
+
+	return string(keyBytes), nil
+}
+
+// attributeShardKey identifies a shard of the keys with an attribute value.
+func attributeShardKey(indexKey string, shard string) string {
+	return indexKey + "/" + shard
+}
+
+func openAttributeIndex(rootPath string, mode LockMode) (*attributeIndex, error) {
+	names := make(map[string]bool)
+
+	namesBytes, err := ioutil.ReadFile(path.Join(rootPath, indexedAttributesFileName))
+	if err == nil {
+		var namesJSON attributeNamesJSON
+		err = json.Unmarshal(namesBytes, &namesJSON)
+		if err != nil {
+			return nil, &kindError{kind: ErrCorruptManifest, err: err}
+		}
+		for _, name := range namesJSON.Indexed {
+			names[name] = true
+		}
+		for _, name := range namesJSON.Building {
+			names[name] = false
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, storeFailure(err)
+	}
+
+	keys, err := openKevaStore(path.Join(rootPath, attributeIndexDir), mode)
+	if err != nil {
+		return nil, storeFailure(err)
+	}
+
+	return &attributeIndex{
+		rootPath: rootPath,
+		keys:     keys,
+		names:    names,
+	}, nil
+}
+
+type attributeNamesJSON struct {
+	Indexed  []string `json:"indexed"`
+	Building []string `json:"building,omitempty"`
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+
+	"github.com/mandykoh/simian"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "ingest":
+		ingest(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func ingest(args []string) {
+	flags := flag.NewFlagSet("ingest", flag.ExitOnError)
+	batchSize := flags.Int("batch-size", 0, "number of entries to write at once (defaults to 100)")
+	maxEntryDifference := flags.Float64("max-entry-difference", 0, "max entry difference for a new index")
+	maxFingerprintSize := flags.Int("max-fingerprint-size", 0, "max fingerprint size for a new index")
+	workers := flags.Int("workers", 0, "number of images to decode at once (defaults to the number of CPUs)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: simian ingest [flags] <index directory> <image directory>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	index, err := simian.NewIndex(flags.Arg(0), *maxFingerprintSize, *maxEntryDifference)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't open index: %v\n", err)
+		os.Exit(1)
+	}
+	defer index.Close()
+
+	progress, err := index.IngestDirectory(context.Background(), flags.Arg(1),
+		simian.UsingWorkers(*workers),
+		simian.WritingBatchesOf(*batchSize),
+		simian.ReportingResults(func(r simian.IngestResult) {
+			if r.Err != nil {
+				fmt.Fprintf(os.Stderr, "\r%s: %v\n", r.Name, r.Err)
+			}
+		}),
+		simian.ReportingProgress(func(p simian.IngestProgress) {
+			fmt.Fprintf(os.Stderr, "\rAdded %d, failed %d", p.Added, p.Failed)
+		}))
+	fmt.Fprintln(os.Stderr)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Ingestion failed: %v\n", err)
+		index.Close()
+		os.Exit(1)
+	}
+
+	fmt.Printf("Added %d images, %d failed\n", progress.Added, progress.Failed)
+}
+
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be changed without changing anything")
+	maxEntryDifference := flags.Float64("max-entry-difference", 0, "max entry difference the index was created with (required for indexes without a manifest)")
+	maxFingerprintSize := flags.Int("max-fingerprint-size", 0, "max fingerprint size the index was created with (inferred if not given)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: simian migrate [flags] <index directory>\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	report, err := simian.Migrate(flags.Arg(0), *dryRun,
+		simian.WithMaxEntryDifference(*maxEntryDifference),
+		simian.WithMaxFingerprintSize(*maxFingerprintSize))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Migration failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if report.FromVersion == report.ToVersion {
+		fmt.Printf("Index is already at format version %d\n", report.ToVersion)
+		return
+	}
+
+	verb := "Migrated"
+	if *dryRun {
+		verb = "Would migrate"
+	}
+
+	fmt.Printf("%s index from format version %d to %d\n", verb, report.FromVersion, report.ToVersion)
+	fmt.Printf("  Nodes visited:      %d\n", report.NodesVisited)
+	fmt.Printf("  Entries keyed:      %d\n", report.EntriesKeyed)
+	fmt.Printf("  Thumbnails copied:  %d\n", report.ThumbnailsCopied)
+	fmt.Printf("  Thumbnails removed: %d\n", report.ThumbnailsRemoved)
+	fmt.Printf("  Child bounds set:   %d\n", report.ChildBoundsSet)
+	fmt.Printf("  Manifest written:   %t\n", report.ManifestWritten)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: simian <command> [arguments]\n\n")
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  ingest     add the images in a directory to an index\n")
+	fmt.Fprintf(os.Stderr, "  migrate    upgrade an index directory to the current format\n")
+	os.Exit(2)
+}
@@ -1,132 +1,549 @@
 package simian
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"sync"
 
 	"github.com/mandykoh/keva"
 )
 
+const manifestFileName = "manifest.json"
 const nodeFingerprintFile = "fingerprint"
 const nodeEntriesDir = "entries"
 const thumbnailsDir = "thumbnails"
 
+// LockMode determines how a DiskIndexStore shares its directory with other
+// processes.
+type LockMode int
+
+const (
+	// LockExclusive allows a single process to read and write the store.
+	LockExclusive LockMode = iota
+
+	// LockShared allows many processes to read the store at once, but none
+	// of them can write to it.
+	LockShared
+)
+
 type DiskIndexStore struct {
-	rootPath string
-	nodes    *keva.Store
+	rootPath   string
+	nodes      *keva.Store
+	entries    *keva.Store
+	attributes *attributeIndex
+	logger     Logger
+	lockMode   LockMode
+	lockFile   *os.File
+
+	// Guards the keva stores, so that concurrent readers can share the store.
+	mutex sync.Mutex
 }
 
-func (s *DiskIndexStore) AddEntry(entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+func (s *DiskIndexStore) AddEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
 	err := entry.saveThumbnail(s.pathForThumbnail(entry))
 	if err != nil {
-		return err
+		return storeFailureForNode(nodeFingerprint, err)
 	}
 
 	node.registerEntry(entry)
 
-	fmt.Printf("AddEntry - Saving [%s] %d %d\n", nodeFingerprint.String(), len(node.childFingerprints), len(node.entries))
-	return s.nodes.Put(nodeFingerprint.String(), node)
+	err = s.putNode(nodeFingerprint, node)
+	if err != nil {
+		return err
+	}
+
+	err = s.putEntryLocation(entry.Key, nodeFingerprint)
+	if err != nil {
+		return err
+	}
+
+	return s.attributes.add(entry.Key, entry.Attributes)
 }
 
 func (s *DiskIndexStore) Close() error {
-	return s.nodes.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.attributes.close()
+	if err != nil {
+		closeKevaStore(s.entries)
+		closeKevaStore(s.nodes)
+		unlockIndex(s.lockFile)
+		return storeFailure(err)
+	}
+
+	err = closeKevaStore(s.entries)
+	if err != nil {
+		closeKevaStore(s.nodes)
+		unlockIndex(s.lockFile)
+		return storeFailure(err)
+	}
+
+	err = closeKevaStore(s.nodes)
+	if err != nil {
+		unlockIndex(s.lockFile)
+		return storeFailure(err)
+	}
+
+	return unlockIndex(s.lockFile)
 }
 
-func (s *DiskIndexStore) GetChild(f Fingerprint, parent *IndexNode) (*IndexNode, error) {
-	var node IndexNode
+func (s *DiskIndexStore) ExpandChildBounds(ctx context.Context, f Fingerprint, entryFingerprint Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	err := s.nodes.Get(f.String(), &node)
-	if err == keva.ErrValueNotFound {
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
+	if !parent.expandChildBounds(f, entryFingerprint) {
+		return nil
+	}
+
+	return s.putNode(parentFingerprint, parent)
+}
+
+func (s *DiskIndexStore) GetChild(ctx context.Context, f Fingerprint, parent *IndexNode) (*IndexNode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.getNode(f)
+}
+
+func (s *DiskIndexStore) GetEntry(ctx context.Context, key string) (*IndexEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	entry, _, nodeFingerprint, err := s.getEntryAndNode(key)
+	if err == ErrEntryNotFound {
 		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
 
-	} else if err == nil {
-		err = s.loadThumbnails(&node)
-		if err != nil {
-			return nil, err
-		}
+	err = entry.loadThumbnail(s.pathForThumbnail(entry))
+	if err != nil {
+		return nil, storeFailureForNode(nodeFingerprint, err)
+	}
 
-	} else {
+	return entry, nil
+}
+
+func (s *DiskIndexStore) GetManifest(ctx context.Context) (*IndexManifest, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
 
-	return &node, nil
+	manifestBytes, err := ioutil.ReadFile(path.Join(s.rootPath, manifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, storeFailure(err)
+	}
+
+	var manifest IndexManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return nil, &kindError{kind: ErrCorruptManifest, err: err}
+	}
+
+	return &manifest, nil
 }
 
-func (s *DiskIndexStore) GetOrCreateChild(f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error) {
-	fmt.Printf("GetOrCreateChild() %s\n", f.String())
+func (s *DiskIndexStore) GetOrCreateChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	nodeKey := f.String()
+	node, err := s.getNode(f)
+	if err != nil {
+		return nil, err
+	}
 
-	var node IndexNode
-	err := s.nodes.Get(nodeKey, &node)
+	if _, registered := parent.childFingerprintsByString[f.String()]; node != nil && registered {
+		return node, nil
+	}
 
-	if err == keva.ErrValueNotFound {
-		fmt.Printf("Creating child\n")
+	if s.lockMode == LockShared {
+		return nil, ErrReadOnly
+	}
 
-		node = IndexNode{
+	if node == nil {
+		s.log().Debug("creating node", "fingerprint", f.String())
+
+		node = &IndexNode{
 			childFingerprintsByString: make(map[string]*Fingerprint),
 		}
+	} else {
+		s.log().Debug("sharing node", "fingerprint", f.String(), "parents", node.parentCount+1)
+	}
 
-		fmt.Printf("GetOrCreateChild - Saving [%s] %d %d\n", nodeKey, len(node.childFingerprints), len(node.entries))
-		err = s.nodes.Put(nodeKey, &node)
-		if err != nil {
-			return nil, err
-		}
+	node.parentCount++
 
-		parent.registerChild(f)
-		fmt.Printf("GetOrCreateChild - Parent - Saving [%s] %d %d\n", parentFingerprint.String(), len(parent.childFingerprints), len(parent.entries))
-		err = s.nodes.Put(parentFingerprint.String(), parent)
-		if err != nil {
-			return nil, err
+	err = s.putNode(f, node)
+	if err != nil {
+		return nil, err
+	}
+
+	parent.registerChild(f)
+	err = s.putNode(parentFingerprint, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+func (s *DiskIndexStore) GetRoot(ctx context.Context) (*IndexNode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var rootFingerprint Fingerprint
+
+	root, err := s.getNode(rootFingerprint)
+	if err != nil {
+		return nil, err
+
+	} else if root == nil {
+		s.log().Debug("creating root node")
+		root = &IndexNode{
+			childFingerprintsByString: make(map[string]*Fingerprint),
 		}
 
-	} else if err == nil {
-		err = s.loadThumbnails(&node)
+	} else {
+		s.log().Debug("loaded root node", "children", len(root.childFingerprints), "entries", len(root.entries))
+	}
+
+	return root, nil
+}
+
+// IndexAttributes starts keeping track of which entries have which values for
+// the named attributes, so that they can be found with KeysWithAttribute. The
+// attributes stay indexed whenever the store is reopened. Entries already in
+// the store are indexed before this returns, so it mustn't be called while the
+// store is being written to. Use Index.IndexAttributes for a store belonging to
+// an Index, which holds off its writers until then. If that's interrupted, the
+// attributes can't be queried until a later call finishes indexing them.
+func (s *DiskIndexStore) IndexAttributes(ctx context.Context, names ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
+	building, err := s.attributes.startBuilding(names)
+	if err != nil || len(building) == 0 {
+		return err
+	}
+
+	s.log().Debug("indexing attributes", "names", building)
+
+	var rootFingerprint Fingerprint
+	visited := make(map[string]bool)
+
+	err = s.walkNodes(ctx, rootFingerprint, visited, func(node *IndexNode) error {
+		return node.withEachEntry(func(entry *IndexEntry) error {
+			return s.attributes.add(entry.Key, entry.Attributes)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.attributes.finishBuilding(building)
+}
+
+// IndexedAttributes returns the names of the attributes being indexed, in
+// sorted order.
+func (s *DiskIndexStore) IndexedAttributes() []string {
+	return s.attributes.sortedNames()
+}
+
+// KeysWithAttribute returns the keys of the entries whose named attribute
+// equals any of the given values, in sorted order. The attribute must have
+// been indexed with IndexAttributes, or ErrAttributeNotIndexed is returned.
+func (s *DiskIndexStore) KeysWithAttribute(ctx context.Context, name string, values ...interface{}) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if !s.attributes.has(name) {
+		return nil, ErrAttributeNotIndexed
+	}
+
+	var keys []string
+	for _, value := range values {
+		valueKeys, err := s.attributes.keysWithValue(name, value)
 		if err != nil {
 			return nil, err
 		}
+		keys = append(keys, valueKeys...)
+	}
 
-	} else {
-		return nil, err
+	// The same entry can't have two values, but the same value may be given
+	// twice
+	if len(values) > 1 {
+		sort.Strings(keys)
+		keys = uniqueSortedStrings(keys)
 	}
 
-	return &node, nil
+	return keys, nil
 }
 
-func (s *DiskIndexStore) GetRoot() (*IndexNode, error) {
-	var rootKey = Fingerprint{}.String()
+// PutBatch writes the thumbnails of the entries added by the batch, then each
+// changed node once, then the locations of the entries.
+func (s *DiskIndexStore) PutBatch(ctx context.Context, batch *NodeBatch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	var root IndexNode
-	err := s.nodes.Get(rootKey, &root)
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
 
-	if err == keva.ErrValueNotFound {
-		fmt.Printf("Root node not found - creating it\n")
-		root = IndexNode{
-			childFingerprintsByString: make(map[string]*Fingerprint),
+	for _, entry := range batch.Entries {
+		err := entry.saveThumbnail(s.pathForThumbnail(entry))
+		if err != nil {
+			return storeFailureForNode(batch.EntryLocations[entry.Key], err)
 		}
+	}
 
-	} else if err == nil {
-		fmt.Printf("Found root node with %d children and %d entries\n", len(root.childFingerprints), len(root.entries))
+	for _, n := range batch.Nodes {
+		err := s.putNode(n.Fingerprint, n.Node)
+		if err != nil {
+			return err
+		}
+	}
 
-		err = s.loadThumbnails(&root)
+	for key, nodeFingerprint := range batch.EntryLocations {
+		err := s.putEntryLocation(key, nodeFingerprint)
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-	} else {
-		return nil, err
+	for _, entry := range batch.Entries {
+		err := s.attributes.add(entry.Key, entry.Attributes)
+		if err != nil {
+			return err
+		}
 	}
 
-	return &root, nil
+	return nil
 }
 
-func (s *DiskIndexStore) RemoveEntries(node *IndexNode, nodeFingerprint Fingerprint) error {
+// PutManifest writes the manifest to a temporary file before moving it into
+// place, so that a failure part way through doesn't leave it truncated.
+func (s *DiskIndexStore) PutManifest(ctx context.Context, manifest *IndexManifest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := path.Join(s.rootPath, manifestFileName)
+	tempPath := manifestPath + ".tmp"
+
+	err = ioutil.WriteFile(tempPath, manifestBytes, 0600)
+	if err != nil {
+		return storeFailure(err)
+	}
+
+	return storeFailure(os.Rename(tempPath, manifestPath))
+}
+
+func (s *DiskIndexStore) RemoveChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
+	parent.unregisterChild(f)
+
+	err := s.putNode(parentFingerprint, parent)
+	if err != nil {
+		return err
+	}
+
+	child, err := s.readNode(f)
+	if err != nil || child == nil {
+		return err
+	}
+
+	// Keep the child while other parents still refer to it
+	child.parentCount--
+	if child.parentCount > 0 {
+		return s.putNode(f, child)
+	}
+
+	return s.removeNode(f)
+}
+
+func (s *DiskIndexStore) RemoveEntries(ctx context.Context, node *IndexNode, nodeFingerprint Fingerprint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
 	node.removeEntries()
-	fmt.Printf("RemoveEntries - Saving [%s] %d %d\n", nodeFingerprint.String(), len(node.childFingerprints), len(node.entries))
-	return s.nodes.Put(nodeFingerprint.String(), node)
+	return s.putNode(nodeFingerprint, node)
+}
+
+func (s *DiskIndexStore) RemoveEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
+	node.removeEntry(entry.Key)
+
+	err := s.putNode(nodeFingerprint, node)
+	if err != nil {
+		return err
+	}
+
+	err = s.removeEntryLocation(entry.Key, nodeFingerprint)
+	if err != nil {
+		return err
+	}
+
+	err = s.attributes.remove(entry.Key, entry.Attributes)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(s.pathForThumbnail(entry))
+	if err != nil && !os.IsNotExist(err) {
+		return storeFailureForNode(nodeFingerprint, err)
+	}
+
+	return nil
+}
+
+// SetLogger sets the logger which receives store events. Events are
+// discarded if no logger is set.
+func (s *DiskIndexStore) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+func (s *DiskIndexStore) UpdateEntry(ctx context.Context, key string, update func(entry *IndexEntry)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if s.lockMode == LockShared {
+		return ErrReadOnly
+	}
+
+	entry, node, nodeFingerprint, err := s.getEntryAndNode(key)
+	if err != nil {
+		return err
+	}
+
+	updated := entry.copy()
+	update(updated)
+	node.replaceEntry(updated)
+
+	err = s.putNode(nodeFingerprint, node)
+	if err != nil {
+		return err
+	}
+
+	err = s.attributes.remove(key, entry.Attributes)
+	if err != nil {
+		return err
+	}
+
+	return s.attributes.add(key, updated.Attributes)
+}
+
+func (s *DiskIndexStore) getEntryAndNode(key string) (*IndexEntry, *IndexNode, Fingerprint, error) {
+	nodeFingerprint, err := s.getEntryLocation(key)
+	if err != nil {
+		return nil, nil, nodeFingerprint, err
+	}
+
+	node, err := s.readNode(nodeFingerprint)
+	if err != nil {
+		return nil, nil, nodeFingerprint, err
+	} else if node == nil {
+		return nil, nil, nodeFingerprint, ErrEntryNotFound
+	}
+
+	entry := node.entryWithKey(key)
+	if entry == nil {
+		return nil, nil, nodeFingerprint, ErrEntryNotFound
+	}
+
+	return entry, node, nodeFingerprint, nil
+}
+
+// getEntryLocation returns the fingerprint of the node holding the entry with
+// the given key.
+func (s *DiskIndexStore) getEntryLocation(key string) (Fingerprint, error) {
+	var nodeFingerprint Fingerprint
+
+	s.mutex.Lock()
+	err := getKevaValue(s.entries, key, &nodeFingerprint)
+	s.mutex.Unlock()
+
+	if err == keva.ErrValueNotFound {
+		return nodeFingerprint, ErrEntryNotFound
+	} else if err != nil {
+		return nodeFingerprint, storeFailure(err)
+	}
+
+	return nodeFingerprint, nil
+}
+
+func (s *DiskIndexStore) getNode(f Fingerprint) (*IndexNode, error) {
+	node, err := s.readNode(f)
+	if err != nil || node == nil {
+		return nil, err
+	}
+
+	err = s.loadThumbnails(node)
+	if err != nil {
+		return nil, storeFailureForNode(f, err)
+	}
+
+	return node, nil
 }
 
 func (s *DiskIndexStore) loadThumbnails(n *IndexNode) error {
@@ -135,23 +552,209 @@ func (s *DiskIndexStore) loadThumbnails(n *IndexNode) error {
 	})
 }
 
+func (s *DiskIndexStore) log() Logger {
+	if s.logger == nil {
+		return nopLogger{}
+	}
+	return s.logger
+}
+
 func (s *DiskIndexStore) pathForThumbnail(entry *IndexEntry) string {
-	thumbnailHash := sha256.Sum256(entry.MaxFingerprint.Bytes())
-	thumbnailHex := hex.EncodeToString(thumbnailHash[:])
+	thumbnailHex := entry.Key
+
+	// Entries indexed before keys were introduced are stored by fingerprint
+	if thumbnailHex == "" {
+		thumbnailHash := sha256.Sum256(entry.MaxFingerprint.Bytes())
+		thumbnailHex = hex.EncodeToString(thumbnailHash[:])
+	}
+
 	return path.Join(s.rootPath, thumbnailsDir, thumbnailHex[0:2], thumbnailHex[2:4], thumbnailHex[4:])
 }
 
+func (s *DiskIndexStore) putEntryLocation(key string, nodeFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return storeFailureForNode(nodeFingerprint, s.entries.Put(key, &nodeFingerprint))
+}
+
+func (s *DiskIndexStore) putNode(f Fingerprint, node *IndexNode) error {
+	s.log().Debug("saving node", "fingerprint", f.String(), "children", len(node.childFingerprints), "entries", len(node.entries))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return storeFailureForNode(f, s.nodes.Put(f.String(), node))
+}
+
+// readNode loads a node without its thumbnails, returning nil if it doesn't
+// exist. Decoding happens separately from retrieval so that a node which
+// can't be decoded is reported as corrupt rather than as a store failure.
+func (s *DiskIndexStore) readNode(f Fingerprint) (*IndexNode, error) {
+	var raw json.RawMessage
+
+	s.mutex.Lock()
+	err := getKevaValue(s.nodes, f.String(), &raw)
+	s.mutex.Unlock()
+
+	if err == keva.ErrValueNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, storeFailureForNode(f, err)
+	}
+
+	var node IndexNode
+	err = json.Unmarshal(raw, &node)
+	if err != nil {
+		return nil, corruptNode(f, err)
+	}
+
+	return &node, nil
+}
+
+func (s *DiskIndexStore) removeEntryLocation(key string, nodeFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return storeFailureForNode(nodeFingerprint, s.entries.Remove(key))
+}
+
+func (s *DiskIndexStore) removeNode(f Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return storeFailureForNode(f, s.nodes.Remove(f.String()))
+}
+
+// walkNodes calls action on the node with the given fingerprint and every
+// node beneath it, once each.
+func (s *DiskIndexStore) walkNodes(ctx context.Context, f Fingerprint, visited map[string]bool, action func(*IndexNode) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if visited[f.String()] {
+		return nil
+	}
+	visited[f.String()] = true
+
+	node, err := s.readNode(f)
+	if err != nil || node == nil {
+		return err
+	}
+
+	err = action(node)
+	if err != nil {
+		return err
+	}
+
+	for _, cf := range node.childFingerprints {
+		err = s.walkNodes(ctx, cf, visited, action)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NewDiskIndexStore opens the store in the given directory, creating it if
+// necessary, and locks it for exclusive use by this process.
 func NewDiskIndexStore(rootPath string) (*DiskIndexStore, error) {
-	thumbnailsDir := path.Join(rootPath, thumbnailsDir)
-	os.MkdirAll(thumbnailsDir, os.FileMode(0700))
+	return NewDiskIndexStoreWithLockMode(rootPath, LockExclusive)
+}
+
+// NewDiskIndexStoreWithLockMode opens the store in the given directory and
+// takes an advisory lock on it with the given mode. ErrIndexLocked is returned
+// if another process holds a conflicting lock, or ErrLockUnsupported on
+// platforms without advisory locking.
+//
+// With LockExclusive, the store is created if necessary. With LockShared,
+// nothing is created, so that an index can be inspected without changing its
+// directory. Parts of the store which don't exist are treated as empty. On
+// Windows, where a directory can't be locked, a lock file is still created.
+func NewDiskIndexStoreWithLockMode(rootPath string, mode LockMode) (*DiskIndexStore, error) {
+	if mode != LockShared {
+		thumbnailsDir := path.Join(rootPath, thumbnailsDir)
+		err := os.MkdirAll(thumbnailsDir, os.FileMode(0700))
+		if err != nil {
+			return nil, storeFailure(err)
+		}
+	}
 
-	nodeStore, err := keva.NewStore(path.Join(rootPath, "nodes"))
+	lock, err := lockIndex(rootPath, mode)
 	if err != nil {
 		return nil, err
 	}
 
+	nodeStore, err := openKevaStore(path.Join(rootPath, "nodes"), mode)
+	if err != nil {
+		unlockIndex(lock)
+		return nil, storeFailure(err)
+	}
+
+	entryStore, err := openKevaStore(path.Join(rootPath, nodeEntriesDir), mode)
+	if err != nil {
+		closeKevaStore(nodeStore)
+		unlockIndex(lock)
+		return nil, storeFailure(err)
+	}
+
+	attributes, err := openAttributeIndex(rootPath, mode)
+	if err != nil {
+		closeKevaStore(entryStore)
+		closeKevaStore(nodeStore)
+		unlockIndex(lock)
+		return nil, err
+	}
+
 	return &DiskIndexStore{
-		rootPath: rootPath,
-		nodes:    nodeStore,
+		rootPath:   rootPath,
+		nodes:      nodeStore,
+		entries:    entryStore,
+		attributes: attributes,
+		lockMode:   mode,
+		lockFile:   lock,
 	}, nil
 }
+
+// closeKevaStore closes a store opened by openKevaStore.
+func closeKevaStore(store *keva.Store) error {
+	if store == nil {
+		return nil
+	}
+	return store.Close()
+}
+
+// getKevaValue gets a value from a store opened by openKevaStore, which has
+// no values if it doesn't exist.
+func getKevaValue(store *keva.Store, key string, value interface{}) error {
+	if store == nil {
+		return keva.ErrValueNotFound
+	}
+	return store.Get(key, value)
+}
+
+// openKevaStore opens the key-value store in the given directory. Unless the
+// mode is LockShared, the directory is created if necessary. Otherwise, nil is
+// returned if it doesn't exist.
+func openKevaStore(dir string, mode LockMode) (*keva.Store, error) {
+	if mode == LockShared {
+		_, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	return keva.NewStore(dir)
+}
+
+func uniqueSortedStrings(values []string) []string {
+	unique := values[:0]
+	for _, v := range values {
+		if len(unique) == 0 || v != unique[len(unique)-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,439 @@
+package simian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+)
+
+func TestDiskIndexStore(t *testing.T) {
+
+	testEntry := func() *IndexEntry {
+		img := image.NewNRGBA(image.Rectangle{Max: image.Point{X: 16, Y: 16}})
+		for i := img.Bounds().Min.Y; i < img.Bounds().Max.Y; i++ {
+			for j := img.Bounds().Min.X; j < img.Bounds().Max.X; j++ {
+				img.Set(j, i, color.RGBA{uint8(i * 16), uint8(j * 16), 0, 255})
+			}
+		}
+
+		entry, err := NewIndexEntry(img, 4, nil)
+		if err != nil {
+			t.Fatalf("Error creating entry: %v", err)
+		}
+		entry.Key, err = newEntryKey()
+		if err != nil {
+			t.Fatalf("Error creating key: %v", err)
+		}
+
+		return entry
+	}
+
+	withStore := func(t *testing.T, action func(store *DiskIndexStore, dir string)) {
+		dir := t.TempDir()
+
+		store, err := NewDiskIndexStore(dir)
+		if err != nil {
+			t.Fatalf("Error creating store: %v", err)
+		}
+		defer store.Close()
+
+		action(store, dir)
+	}
+
+	t.Run("GetRoot()", func(t *testing.T) {
+
+		t.Run("should report a corrupt node with its fingerprint", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				var rootFingerprint Fingerprint
+
+				err := store.nodes.Put(rootFingerprint.String(), json.RawMessage(`{"childFingerprints":["not hex"]}`))
+				if err != nil {
+					t.Fatalf("Error writing node: %v", err)
+				}
+
+				_, err = store.GetRoot(context.Background())
+				if !errors.Is(err, ErrCorruptNode) {
+					t.Fatalf("Expected ErrCorruptNode but got %v", err)
+				}
+
+				var nodeErr *NodeError
+				if !errors.As(err, &nodeErr) {
+					t.Fatalf("Expected NodeError but got %T", err)
+				}
+				if actual, expected := nodeErr.Fingerprint.String(), rootFingerprint.String(); actual != expected {
+					t.Errorf("Expected fingerprint '%s' but got '%s'", expected, actual)
+				}
+			})
+		})
+	})
+
+	t.Run("AddEntry()", func(t *testing.T) {
+
+		t.Run("should report a store failure when the thumbnail can't be written", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				thumbnailsPath := path.Join(dir, thumbnailsDir)
+				os.RemoveAll(thumbnailsPath)
+				err := ioutil.WriteFile(thumbnailsPath, nil, 0600)
+				if err != nil {
+					t.Fatalf("Error replacing thumbnails directory: %v", err)
+				}
+
+				root, err := store.GetRoot(context.Background())
+				if err != nil {
+					t.Fatalf("Error getting root: %v", err)
+				}
+
+				var rootFingerprint Fingerprint
+
+				err = store.AddEntry(context.Background(), testEntry(), root, rootFingerprint)
+				if !errors.Is(err, ErrStoreFailure) {
+					t.Fatalf("Expected ErrStoreFailure but got %v", err)
+				}
+
+				var pathErr *os.PathError
+				if !errors.As(err, &pathErr) {
+					t.Errorf("Expected underlying PathError but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("GetChild()", func(t *testing.T) {
+
+		t.Run("should return nil for a nonexistent child", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				root, err := store.GetRoot(context.Background())
+				if err != nil {
+					t.Fatalf("Error getting root: %v", err)
+				}
+
+				child, err := store.GetChild(context.Background(), testEntry().FingerprintForSize(2), root)
+				if err != nil {
+					t.Fatalf("Error getting child: %v", err)
+				}
+				if child != nil {
+					t.Errorf("Expected no child but got %v", child)
+				}
+			})
+		})
+	})
+
+	t.Run("RemoveChild()", func(t *testing.T) {
+
+		t.Run("should keep a child which another parent still refers to", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				root, err := store.GetRoot(context.Background())
+				if err != nil {
+					t.Fatalf("Error getting root: %v", err)
+				}
+
+				var rootFingerprint Fingerprint
+				parent1Fingerprint := Fingerprint{samples: []uint8{0x10, 0x20, 0x30, 0x40}}
+				parent2Fingerprint := Fingerprint{samples: []uint8{0x50, 0x60, 0x70, 0x80}}
+				childFingerprint := Fingerprint{samples: []uint8{0, 0, 0, 0, 0, 0, 0, 0, 0}}
+
+				parent1, err := store.GetOrCreateChild(context.Background(), parent1Fingerprint, root, rootFingerprint)
+				if err != nil {
+					t.Fatalf("Error creating node: %v", err)
+				}
+				parent2, err := store.GetOrCreateChild(context.Background(), parent2Fingerprint, root, rootFingerprint)
+				if err != nil {
+					t.Fatalf("Error creating node: %v", err)
+				}
+
+				for _, parent := range []struct {
+					node        *IndexNode
+					fingerprint Fingerprint
+				}{{parent1, parent1Fingerprint}, {parent2, parent2Fingerprint}} {
+					_, err = store.GetOrCreateChild(context.Background(), childFingerprint, parent.node, parent.fingerprint)
+					if err != nil {
+						t.Fatalf("Error getting child: %v", err)
+					}
+				}
+
+				err = store.RemoveChild(context.Background(), childFingerprint, parent2, parent2Fingerprint)
+				if err != nil {
+					t.Fatalf("Error removing child: %v", err)
+				}
+
+				child, err := store.GetChild(context.Background(), childFingerprint, parent1)
+				if err != nil {
+					t.Fatalf("Error getting child: %v", err)
+				} else if child == nil {
+					t.Fatalf("Expected child to be kept for its other parent")
+				}
+
+				err = store.RemoveChild(context.Background(), childFingerprint, parent1, parent1Fingerprint)
+				if err != nil {
+					t.Fatalf("Error removing child: %v", err)
+				}
+
+				child, err = store.GetChild(context.Background(), childFingerprint, parent1)
+				if err != nil {
+					t.Fatalf("Error getting child: %v", err)
+				} else if child != nil {
+					t.Errorf("Expected child to be removed once no parents refer to it")
+				}
+			})
+		})
+	})
+
+	t.Run("FindNearest()", func(t *testing.T) {
+
+		t.Run("should report a missing child as a corrupt node", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				entry := testEntry()
+				childFingerprint := entry.FingerprintForSize(2)
+
+				index, err := NewIndexWithStore(store, WithMaxFingerprintSize(4))
+				if err != nil {
+					t.Fatalf("Error creating index: %v", err)
+				}
+
+				var rootFingerprint Fingerprint
+
+				root := &IndexNode{childFingerprintsByString: make(map[string]*Fingerprint)}
+				root.registerChild(childFingerprint)
+				err = store.putNode(rootFingerprint, root)
+				if err != nil {
+					t.Fatalf("Error writing root: %v", err)
+				}
+
+				_, err = index.FindNearest(entry.Thumbnail, 10, 0.5)
+				if !errors.Is(err, ErrCorruptNode) {
+					t.Fatalf("Expected ErrCorruptNode but got %v", err)
+				}
+
+				var nodeErr *NodeError
+				if !errors.As(err, &nodeErr) {
+					t.Fatalf("Expected NodeError but got %T", err)
+				}
+				if actual, expected := nodeErr.Fingerprint.String(), childFingerprint.String(); actual != expected {
+					t.Errorf("Expected fingerprint '%s' but got '%s'", expected, actual)
+				}
+			})
+		})
+	})
+	t.Run("KeysWithAttribute()", func(t *testing.T) {
+
+		withIndex := func(t *testing.T, store *DiskIndexStore) *Index {
+			index, err := NewIndexWithStore(store, WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+			return index
+		}
+
+		t.Run("should find entries added, updated and removed through the index", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				ctx := context.Background()
+
+				err := store.IndexAttributes(ctx, "source")
+				if err != nil {
+					t.Fatalf("Error indexing attributes: %v", err)
+				}
+
+				index := withIndex(t, store)
+
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImageWithSeed(i), map[string]interface{}{"source": i % 2, "other": "x"})
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				err = index.UpdateAttributes(keys[0], map[string]interface{}{"source": "upload-42"})
+				if err != nil {
+					t.Fatalf("Error updating attributes: %v", err)
+				}
+				err = index.ReplaceAttributes(keys[2], nil)
+				if err != nil {
+					t.Fatalf("Error replacing attributes: %v", err)
+				}
+				err = index.Remove(keys[4])
+				if err != nil {
+					t.Fatalf("Error removing entry: %v", err)
+				}
+
+				found, err := store.KeysWithAttribute(ctx, "source", "upload-42")
+				if err != nil {
+					t.Fatalf("Error querying attribute: %v", err)
+				}
+				if len(found) != 1 || found[0] != keys[0] {
+					t.Errorf("Expected only the updated entry but got %v", found)
+				}
+
+				found, err = store.KeysWithAttribute(ctx, "source", 1.0)
+				if err != nil {
+					t.Fatalf("Error querying attribute: %v", err)
+				}
+
+				expected := make(map[string]bool)
+				for i := 7; i <= 20; i += 2 {
+					expected[keys[i-1]] = true
+				}
+				if len(found) != len(expected) {
+					t.Errorf("Expected %d entries but got %d", len(expected), len(found))
+				}
+				for _, key := range found {
+					if !expected[key] {
+						t.Errorf("Unexpected entry '%s'", key)
+					}
+				}
+
+				found, err = store.KeysWithAttribute(ctx, "source", 0, 1, 1.0)
+				if err != nil {
+					t.Fatalf("Error querying attribute: %v", err)
+				}
+				if len(found) != 20-3 {
+					t.Errorf("Expected %d entries but got %d", 20-3, len(found))
+				}
+			})
+		})
+
+		t.Run("should index existing entries and remember indexed attributes when reopened", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				ctx := context.Background()
+				index := withIndex(t, store)
+
+				var keys []string
+				for i := 1; i <= 10; i++ {
+					key, err := index.Add(testImageWithSeed(i), map[string]interface{}{"source": "upload-42"})
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				err := store.IndexAttributes(ctx, "source")
+				if err != nil {
+					t.Fatalf("Error indexing attributes: %v", err)
+				}
+
+				store.Close()
+
+				reopened, err := NewDiskIndexStore(dir)
+				if err != nil {
+					t.Fatalf("Error reopening store: %v", err)
+				}
+				defer reopened.Close()
+
+				if names := reopened.IndexedAttributes(); len(names) != 1 || names[0] != "source" {
+					t.Errorf("Expected 'source' to be indexed but got %v", names)
+				}
+
+				found, err := reopened.KeysWithAttribute(ctx, "source", "upload-42")
+				if err != nil {
+					t.Fatalf("Error querying attribute: %v", err)
+				}
+				if len(found) != len(keys) {
+					t.Errorf("Expected %d entries but got %d", len(keys), len(found))
+				}
+			})
+		})
+
+		t.Run("should finish indexing attributes whose indexing was interrupted", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				ctx := context.Background()
+				index := withIndex(t, store)
+
+				var keys []string
+				for i := 1; i <= 10; i++ {
+					key, err := index.Add(testImageWithSeed(i), map[string]interface{}{"source": "upload-42"})
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				// Simulate being interrupted before existing entries were indexed
+				_, err := store.attributes.startBuilding([]string{"source"})
+				if err != nil {
+					t.Fatalf("Error starting to index attributes: %v", err)
+				}
+
+				store.Close()
+
+				reopened, err := NewDiskIndexStore(dir)
+				if err != nil {
+					t.Fatalf("Error reopening store: %v", err)
+				}
+				defer reopened.Close()
+
+				_, err = reopened.KeysWithAttribute(ctx, "source", "upload-42")
+				if err != ErrAttributeNotIndexed {
+					t.Errorf("Expected ErrAttributeNotIndexed but got %v", err)
+				}
+				if names := reopened.IndexedAttributes(); len(names) != 0 {
+					t.Errorf("Expected no indexed attributes but got %v", names)
+				}
+
+				err = reopened.IndexAttributes(ctx)
+				if err != nil {
+					t.Fatalf("Error indexing attributes: %v", err)
+				}
+
+				found, err := reopened.KeysWithAttribute(ctx, "source", "upload-42")
+				if err != nil {
+					t.Fatalf("Error querying attribute: %v", err)
+				}
+				if len(found) != len(keys) {
+					t.Errorf("Expected %d entries but got %d", len(keys), len(found))
+				}
+				if !sort.StringsAreSorted(found) {
+					t.Errorf("Expected keys in sorted order but got %v", found)
+				}
+			})
+		})
+
+		t.Run("should fail for an attribute which isn't indexed", func(t *testing.T) {
+			withStore(t, func(store *DiskIndexStore, dir string) {
+				_, err := store.KeysWithAttribute(context.Background(), "source", "upload-42")
+				if err != ErrAttributeNotIndexed {
+					t.Errorf("Expected ErrAttributeNotIndexed but got %v", err)
+				}
+			})
+		})
+	})
+	t.Run("with a shared lock", func(t *testing.T) {
+
+		t.Run("should refuse to write", func(t *testing.T) {
+			dir := t.TempDir()
+
+			store, err := NewDiskIndexStoreWithLockMode(dir, LockShared)
+			if err != nil {
+				t.Fatalf("Error creating store: %v", err)
+			}
+			defer store.Close()
+
+			root, err := store.GetRoot(context.Background())
+			if err != nil {
+				t.Fatalf("Error getting root: %v", err)
+			}
+
+			var rootFingerprint Fingerprint
+
+			err = store.AddEntry(context.Background(), testEntry(), root, rootFingerprint)
+			if err != ErrReadOnly {
+				t.Errorf("Expected ErrReadOnly but got %v", err)
+			}
+			if len(root.entries) != 0 {
+				t.Errorf("Expected root to be unchanged but got %d entries", len(root.entries))
+			}
+
+			err = store.IndexAttributes(context.Background(), "source")
+			if err != ErrReadOnly {
+				t.Errorf("Expected ErrReadOnly but got %v", err)
+			}
+		})
+	})
+}
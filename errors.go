@@ -0,0 +1,93 @@
+package simian
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+var (
+	ErrAttributeNotIndexed    = errors.New("attribute is not indexed")
+	ErrAttributesUnsupported  = errors.New("index store doesn't support attribute indexing")
+	ErrCorruptManifest        = errors.New("corrupt index manifest")
+	ErrCorruptNode            = errors.New("corrupt index node")
+	ErrEmptyBounds            = errors.New("image has empty bounds")
+	ErrEntryNotFound          = errors.New("entry not found")
+	ErrIncompatibleIndex      = errors.New("index is incompatible with requested options")
+	ErrIndexExists            = errors.New("index already exists")
+	ErrIndexLocked            = errors.New("index is locked by another process")
+	ErrInvalidAttributes      = errors.New("attributes must marshal to a JSON object")
+	ErrInvalidFingerprintSize = errors.New("fingerprint size must be at least 1")
+	ErrInvalidImage           = errors.New("invalid image")
+	ErrInvalidIngestSource    = errors.New("ingest source has no Open function")
+	ErrInvalidOptions         = errors.New("invalid index options")
+	ErrLockUnsupported        = errors.New("index locking is not supported on this platform")
+	ErrReadOnly               = errors.New("index store is read only")
+	ErrStoreFailure           = errors.New("index store failure")
+	ErrUnsupportedFormat      = errors.New("unsupported index format")
+)
+
+// ImageError records the bounds of an image which couldn't be fingerprinted.
+type ImageError struct {
+	Bounds image.Rectangle
+	Err    error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("image with bounds %v: %v", e.Bounds, e.Err)
+}
+
+func (e *ImageError) Unwrap() error {
+	return e.Err
+}
+
+// NodeError records the fingerprint of the index node involved in a failure.
+type NodeError struct {
+	Fingerprint Fingerprint
+	Err         error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node [%s]: %v", e.Fingerprint.String(), e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// kindError classifies an underlying error as one of the sentinel errors
+// while still allowing the underlying error to be inspected.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func corruptNode(f Fingerprint, err error) error {
+	return &NodeError{Fingerprint: f, Err: &kindError{kind: ErrCorruptNode, err: err}}
+}
+
+func storeFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &kindError{kind: ErrStoreFailure, err: err}
+}
+
+func storeFailureForNode(f Fingerprint, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &NodeError{Fingerprint: f, Err: storeFailure(err)}
+}
@@ -0,0 +1,18 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!windows
+
+package simian
+
+import (
+	"os"
+)
+
+// Advisory locking isn't supported on this platform, so a store can't be
+// opened without risking another process writing to it at the same time.
+func lockIndex(rootPath string, mode LockMode) (*os.File, error) {
+	return nil, ErrLockUnsupported
+}
+
+func unlockIndex(f *os.File) error {
+	return storeFailure(f.Close())
+}
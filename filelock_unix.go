@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package simian
+
+import (
+	"os"
+	"syscall"
+)
+
+// The index directory itself is locked, so that a reader doesn't need to
+// create anything.
+func lockIndex(rootPath string, mode LockMode) (*os.File, error) {
+	f, err := os.Open(rootPath)
+	if err != nil {
+		return nil, storeFailure(err)
+	}
+
+	how := syscall.LOCK_EX
+	if mode == LockShared {
+		how = syscall.LOCK_SH
+	}
+
+	err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+
+		pathErr := &os.PathError{Op: "lock", Path: rootPath, Err: err}
+		if err == syscall.EWOULDBLOCK {
+			return nil, &kindError{kind: ErrIndexLocked, err: pathErr}
+		}
+		return nil, storeFailure(pathErr)
+	}
+
+	return f, nil
+}
+
+func unlockIndex(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if err != nil {
+		f.Close()
+		return storeFailure(err)
+	}
+
+	return storeFailure(f.Close())
+}
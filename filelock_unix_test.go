@@ -0,0 +1,105 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package simian
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFileLock(t *testing.T) {
+
+	open := func(t *testing.T, dir string, mode LockMode) *DiskIndexStore {
+		store, err := NewDiskIndexStoreWithLockMode(dir, mode)
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		return store
+	}
+
+	t.Run("should prevent a second writer", func(t *testing.T) {
+		dir := t.TempDir()
+
+		store := open(t, dir, LockExclusive)
+		defer store.Close()
+
+		_, err := NewDiskIndexStore(dir)
+		if !errors.Is(err, ErrIndexLocked) {
+			t.Errorf("Expected ErrIndexLocked but got %v", err)
+		}
+	})
+
+	t.Run("should prevent readers while there is a writer", func(t *testing.T) {
+		dir := t.TempDir()
+
+		store := open(t, dir, LockExclusive)
+		defer store.Close()
+
+		_, err := NewDiskIndexStoreWithLockMode(dir, LockShared)
+		if !errors.Is(err, ErrIndexLocked) {
+			t.Errorf("Expected ErrIndexLocked but got %v", err)
+		}
+	})
+
+	t.Run("should prevent a writer while there are readers", func(t *testing.T) {
+		dir := t.TempDir()
+
+		store := open(t, dir, LockShared)
+		defer store.Close()
+
+		_, err := NewDiskIndexStore(dir)
+		if !errors.Is(err, ErrIndexLocked) {
+			t.Errorf("Expected ErrIndexLocked but got %v", err)
+		}
+	})
+
+	t.Run("should prevent a writer while a reader has an index with no lock file", func(t *testing.T) {
+		dir := t.TempDir()
+
+		open(t, dir, LockExclusive).Close()
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("Error listing directory: %v", err)
+		}
+		for _, f := range files {
+			if !f.IsDir() {
+				t.Fatalf("Expected no lock file but found %s", f.Name())
+			}
+		}
+
+		store := open(t, dir, LockShared)
+		defer store.Close()
+
+		_, err = NewDiskIndexStore(dir)
+		if !errors.Is(err, ErrIndexLocked) {
+			t.Errorf("Expected ErrIndexLocked but got %v", err)
+		}
+	})
+
+	t.Run("should allow multiple readers", func(t *testing.T) {
+		dir := t.TempDir()
+
+		store1 := open(t, dir, LockShared)
+		defer store1.Close()
+
+		store2 := open(t, dir, LockShared)
+		defer store2.Close()
+	})
+
+	t.Run("should release the lock when closed", func(t *testing.T) {
+		dir := t.TempDir()
+
+		store := open(t, dir, LockExclusive)
+
+		err := store.Close()
+		if err != nil {
+			t.Fatalf("Error closing store: %v", err)
+		}
+
+		store = open(t, dir, LockExclusive)
+		store.Close()
+	})
+}
@@ -0,0 +1,67 @@
+//go:build windows
+// +build windows
+
+package simian
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"unsafe"
+)
+
+const lockFileName = "lock"
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// LockFileEx can't lock a directory, so a file in the index directory is
+// locked instead.
+func lockIndex(rootPath string, mode LockMode) (*os.File, error) {
+	lockPath := path.Join(rootPath, lockFileName)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, storeFailure(err)
+	}
+
+	flags := uintptr(lockfileFailImmediately)
+	if mode != LockShared {
+		flags |= lockfileExclusiveLock
+	}
+
+	// Lock the first byte, which is enough for the lock to be exclusive
+	var overlapped syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		f.Close()
+
+		pathErr := &os.PathError{Op: "lock", Path: lockPath, Err: err}
+		if err == errorLockViolation {
+			return nil, &kindError{kind: ErrIndexLocked, err: pathErr}
+		}
+		return nil, storeFailure(pathErr)
+	}
+
+	return f, nil
+}
+
+func unlockIndex(f *os.File) error {
+	var overlapped syscall.Overlapped
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if r == 0 {
+		f.Close()
+		return storeFailure(err)
+	}
+
+	return storeFailure(f.Close())
+}
@@ -0,0 +1,25 @@
+package simian
+
+import (
+	"image"
+)
+
+// FingerprintAlgorithm derives fingerprints of a given size from images. An
+// index must always be used with the same algorithm, so each algorithm has a
+// name by which it can be identified.
+type FingerprintAlgorithm interface {
+	Name() string
+	Fingerprint(src image.Image, size int) Fingerprint
+}
+
+// LuminanceFingerprintAlgorithm fingerprints images by their quantised
+// luminance, as produced by NewFingerprint. This is the default.
+type LuminanceFingerprintAlgorithm struct{}
+
+func (LuminanceFingerprintAlgorithm) Name() string {
+	return "luminance"
+}
+
+func (LuminanceFingerprintAlgorithm) Fingerprint(src image.Image, size int) Fingerprint {
+	return NewFingerprint(src, size)
+}
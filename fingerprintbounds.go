@@ -0,0 +1,75 @@
+package simian
+
+import (
+	"math"
+)
+
+// fingerprintBounds is the smallest box containing a set of fingerprints,
+// given by the lowest and highest value of each sample. Fingerprints of
+// different sizes are derived from images independently, so a child's own
+// fingerprint says nothing certain about the entries beneath it. These bounds
+// do, which is what lets a search rule out whole subtrees.
+type fingerprintBounds struct {
+	Min Fingerprint `json:"min"`
+	Max Fingerprint `json:"max"`
+}
+
+func (b *fingerprintBounds) clone() *fingerprintBounds {
+	c := newFingerprintBounds(b.Min)
+	c.expand(b.Max)
+	return c
+}
+
+// expand grows the bounds to contain the given fingerprint, and reports
+// whether they changed.
+func (b *fingerprintBounds) expand(f Fingerprint) bool {
+	if len(f.samples) != len(b.Min.samples) {
+		return false
+	}
+
+	changed := false
+
+	for i, sample := range f.samples {
+		if sample < b.Min.samples[i] {
+			b.Min.samples[i] = sample
+			changed = true
+		}
+		if sample > b.Max.samples[i] {
+			b.Max.samples[i] = sample
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// lowerBound returns the smallest difference there can be between the given
+// fingerprint and any fingerprint within the bounds.
+func (b *fingerprintBounds) lowerBound(f Fingerprint) float64 {
+	if len(f.samples) != len(b.Min.samples) || len(f.samples) == 0 {
+		return 0
+	}
+
+	var dist uint64
+
+	for i, sample := range f.samples {
+		if sample < b.Min.samples[i] {
+			dist += uint64(b.Min.samples[i] - sample)
+		} else if sample > b.Max.samples[i] {
+			dist += uint64(sample - b.Max.samples[i])
+		}
+	}
+
+	return math.Min(float64(dist)/float64(len(f.samples)*255), 1.0)
+}
+
+func newFingerprintBounds(f Fingerprint) *fingerprintBounds {
+	b := &fingerprintBounds{
+		Min: Fingerprint{samples: make([]uint8, len(f.samples))},
+		Max: Fingerprint{samples: make([]uint8, len(f.samples))},
+	}
+	copy(b.Min.samples, f.samples)
+	copy(b.Max.samples, f.samples)
+
+	return b
+}
@@ -0,0 +1,68 @@
+package simian
+
+import (
+	"testing"
+)
+
+func TestFingerprintBounds(t *testing.T) {
+
+	t.Run("lowerBound()", func(t *testing.T) {
+
+		t.Run("should be zero within the bounds", func(t *testing.T) {
+			b := newFingerprintBounds(Fingerprint{samples: []uint8{0x10, 0x80, 0xf0, 0x00}})
+			b.expand(Fingerprint{samples: []uint8{0x30, 0x40, 0xf0, 0x20}})
+
+			if bound := b.lowerBound(Fingerprint{samples: []uint8{0x20, 0x60, 0xf0, 0x10}}); bound != 0 {
+				t.Errorf("Expected lower bound of zero but got %v", bound)
+			}
+		})
+
+		t.Run("should never exceed the difference to a fingerprint within the bounds", func(t *testing.T) {
+			fingerprints := []Fingerprint{
+				{samples: []uint8{0x10, 0x80, 0xf0, 0x00}},
+				{samples: []uint8{0x30, 0x40, 0xf0, 0x20}},
+				{samples: []uint8{0x20, 0x90, 0xa0, 0x10}},
+			}
+
+			b := newFingerprintBounds(fingerprints[0])
+			for _, f := range fingerprints[1:] {
+				b.expand(f)
+			}
+
+			query := Fingerprint{samples: []uint8{0x00, 0xf0, 0x50, 0x60}}
+
+			bound := b.lowerBound(query)
+			if bound == 0 {
+				t.Errorf("Expected nonzero lower bound for a fingerprint outside the bounds")
+			}
+
+			for _, f := range fingerprints {
+				if diff := f.Difference(query); bound > diff {
+					t.Errorf("Expected lower bound %v not to exceed difference %v", bound, diff)
+				}
+			}
+		})
+
+		t.Run("should be zero for a fingerprint of a different size", func(t *testing.T) {
+			b := newFingerprintBounds(Fingerprint{samples: []uint8{0x10, 0x80, 0xf0, 0x00}})
+
+			if bound := b.lowerBound(Fingerprint{samples: []uint8{0xf0}}); bound != 0 {
+				t.Errorf("Expected lower bound of zero but got %v", bound)
+			}
+		})
+	})
+
+	t.Run("expand()", func(t *testing.T) {
+
+		t.Run("should report whether the bounds changed", func(t *testing.T) {
+			b := newFingerprintBounds(Fingerprint{samples: []uint8{0x10, 0x80}})
+
+			if !b.expand(Fingerprint{samples: []uint8{0x00, 0x80}}) {
+				t.Errorf("Expected bounds to change")
+			}
+			if b.expand(Fingerprint{samples: []uint8{0x10, 0x80}}) {
+				t.Errorf("Expected bounds not to change")
+			}
+		})
+	})
+}
@@ -1,74 +1,459 @@
 package simian
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"image"
-	"math"
 	"os"
-	"sort"
+	"sync"
 )
 
 const rootFingerprintSize = 1
 
+// Index is safe for concurrent use. Searches and lookups run concurrently with
+// each other, while changes to the index are serialised. Because a change can
+// split a node and rewrite its parent, writers are serialised across the whole
+// index rather than per subtree.
+//
+// Each method has a variant taking a context, which is passed on to the store
+// and checked between loading nodes. A method stopped by its context returns
+// the context's error.
 type Index struct {
-	Store              IndexStore
-	maxFingerprintSize int
-	maxEntryDifference float64
+	Store IndexStore
+
+	maxFingerprintSize      int
+	maxEntryDifference      float64
+	thumbnailSizeMultiplier int
+	minThumbnailSize        int
+	fingerprintAlgorithm    FingerprintAlgorithm
+	logger                  Logger
+	mutex                   sync.RWMutex
 }
 
 func (i *Index) Add(image image.Image, metadata map[string]interface{}) (key string, err error) {
-	entry, err := NewIndexEntry(image, i.maxFingerprintSize, metadata)
+	return i.AddContext(context.Background(), image, metadata)
+}
+
+// AddContext is like Add, but doesn't add the entry if the context is done
+// before the tree starts being changed. Once it has started, the entry is
+// always added.
+func (i *Index) AddContext(ctx context.Context, image image.Image, metadata map[string]interface{}) (key string, err error) {
+	entry, err := i.newEntry(image, metadata)
+	if err != nil {
+		return "", err
+	}
+
+	entry.Key, err = newEntryKey()
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
-	root, err := i.Store.GetRoot()
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	root, err := i.Store.GetRoot(ctx)
 	if err != nil {
 		return "", err
 	}
 
 	var rootFingerprint Fingerprint
 
-	_, err = root.Add(entry, rootFingerprint, rootFingerprintSize+1, i)
+	_, err = root.Add(ctx, entry, rootFingerprint, rootFingerprintSize+1, i)
 	if err != nil {
 		return "", err
 	}
 
-	fmt.Printf("Root node has %d children and %d entries\n", len(root.childFingerprints), len(root.entries))
+	i.log().Debug("entry added", "key", entry.Key, "rootChildren", len(root.childFingerprints), "rootEntries", len(root.entries))
 
-	return "", nil
+	return entry.Key, nil
+}
+
+func (i *Index) AddBatch(entries []BatchEntry) (keys []string, err error) {
+	return i.AddBatchContext(context.Background(), entries)
+}
+
+// AddBatchContext adds many entries at once, returning their keys in the same
+// order as the entries. The batch is added to copies of the nodes it changes,
+// including any splits, and then each changed node is written to the store
+// once rather than once for every entry. If an error is returned before the
+// store starts writing, including when the context is done, none of the
+// entries are added.
+func (i *Index) AddBatchContext(ctx context.Context, entries []BatchEntry) (keys []string, err error) {
+	newEntries := make([]*IndexEntry, len(entries))
+	keys = make([]string, len(entries))
+
+	for n, e := range entries {
+		entry, err := i.newEntry(e.Image, e.Attributes)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Key, err = newEntryKey()
+		if err != nil {
+			return nil, err
+		}
+
+		newEntries[n] = entry
+		keys[n] = entry.Key
+	}
+
+	err = i.addBatch(ctx, newEntries)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
 }
 
 func (i *Index) Close() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
 	return i.Store.Close()
 }
 
-func (i *Index) FindNearest(image image.Image, maxResults int, maxDifference float64) ([]*IndexEntry, error) {
+// FindNearest returns the entries most similar to the given image, nearest
+// first. Use Search to also get how similar each one is.
+func (i *Index) FindNearest(image image.Image, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return i.FindNearestContext(context.Background(), image, maxResults, maxDifference, options...)
+}
+
+func (i *Index) FindNearestContext(ctx context.Context, image image.Image, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return resultEntries(i.SearchContext(ctx, image, maxResults, maxDifference, options...))
+}
+
+// FindNearestToFingerprint is like SearchByFingerprint, but returns only the
+// entries.
+func (i *Index) FindNearestToFingerprint(f Fingerprint, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return i.FindNearestToFingerprintContext(context.Background(), f, maxResults, maxDifference, options...)
+}
+
+func (i *Index) FindNearestToFingerprintContext(ctx context.Context, f Fingerprint, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return resultEntries(i.SearchByFingerprintContext(ctx, f, maxResults, maxDifference, options...))
+}
+
+// FindNearestToKey is like SearchByKey, but returns only the entries.
+func (i *Index) FindNearestToKey(key string, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return i.FindNearestToKeyContext(context.Background(), key, maxResults, maxDifference, options...)
+}
+
+func (i *Index) FindNearestToKeyContext(ctx context.Context, key string, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return resultEntries(i.SearchByKeyContext(ctx, key, maxResults, maxDifference, options...))
+}
+
+// FindWithin calls the given function with every entry within the max
+// difference of the given image, in no particular order, until the function
+// returns false. Results aren't collected, so any number of them can be
+// handled.
+//
+// The index is read locked until the search finishes, so writers wait for the
+// function too. No method of the index may be called from within the
+// function, as it can deadlock once a writer is waiting.
+func (i *Index) FindWithin(image image.Image, maxDifference float64, fn func(SearchResult) bool, options ...SearchOption) error {
+	return i.FindWithinContext(context.Background(), image, maxDifference, fn, options...)
+}
+
+func (i *Index) FindWithinContext(ctx context.Context, image image.Image, maxDifference float64, fn func(SearchResult) bool, options ...SearchOption) error {
+	var dummy map[string]interface{}
+
+	entry, err := i.newEntry(image, dummy)
+	if err != nil {
+		return err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	o := newSearchOptions(options)
+
+	root, err := i.Store.GetRoot(ctx)
+	if err != nil {
+		o.traceEnd(SearchFailed, err)
+		return err
+	}
+
+	var rootFingerprint Fingerprint
+
+	err = root.FindWithin(ctx, entry, rootFingerprint, rootFingerprintSize+1, i, maxDifference, o, fn)
+	if err != nil {
+		o.traceEnd(SearchFailed, err)
+	}
+
+	return err
+}
+
+func (i *Index) Get(key string) (*IndexEntry, error) {
+	return i.GetContext(context.Background(), key)
+}
+
+func (i *Index) GetContext(ctx context.Context, key string) (*IndexEntry, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.Store.GetEntry(ctx, key)
+}
+
+// IndexAttributes starts indexing the named attributes, so that entries can be
+// found by their values with KeysWithAttribute. The index can't be written to
+// until the entries already in it have been indexed. ErrAttributesUnsupported
+// is returned if the store can't index attributes.
+func (i *Index) IndexAttributes(names ...string) error {
+	return i.IndexAttributesContext(context.Background(), names...)
+}
+
+func (i *Index) IndexAttributesContext(ctx context.Context, names ...string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	s, ok := i.Store.(interface {
+		IndexAttributes(context.Context, ...string) error
+	})
+	if !ok {
+		return ErrAttributesUnsupported
+	}
+
+	return s.IndexAttributes(ctx, names...)
+}
+
+// KeysWithAttribute returns the keys of the entries whose named attribute
+// equals any of the given values, in sorted order. ErrAttributeNotIndexed is
+// returned if the attribute hasn't been indexed with IndexAttributes, or
+// ErrAttributesUnsupported if the store can't index attributes.
+func (i *Index) KeysWithAttribute(name string, values ...interface{}) ([]string, error) {
+	return i.KeysWithAttributeContext(context.Background(), name, values...)
+}
+
+func (i *Index) KeysWithAttributeContext(ctx context.Context, name string, values ...interface{}) ([]string, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	s, ok := i.Store.(interface {
+		KeysWithAttribute(context.Context, string, ...interface{}) ([]string, error)
+	})
+	if !ok {
+		return nil, ErrAttributesUnsupported
+	}
+
+	return s.KeysWithAttribute(ctx, name, values...)
+}
+
+func (i *Index) Remove(key string) error {
+	return i.RemoveContext(context.Background(), key)
+}
+
+// RemoveContext is like Remove, but doesn't remove the entry if the context is
+// done before the tree starts being changed. Once it has started, the entry is
+// always removed.
+func (i *Index) RemoveContext(ctx context.Context, key string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	entry, err := i.Store.GetEntry(ctx, key)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	root, err := i.Store.GetRoot(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rootFingerprint Fingerprint
+
+	_, err = root.Remove(ctx, entry, rootFingerprint, rootFingerprintSize+1, i)
+	return err
+}
+
+func (i *Index) ReplaceAttributes(key string, attributes map[string]interface{}) error {
+	return i.ReplaceAttributesContext(context.Background(), key, attributes)
+}
+
+func (i *Index) ReplaceAttributesContext(ctx context.Context, key string, attributes map[string]interface{}) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return i.Store.UpdateEntry(ctx, key, func(entry *IndexEntry) {
+		entry.Attributes = copyAttributes(attributes)
+	})
+}
+
+// Search returns the entries most similar to the given image, nearest first,
+// along with how different each one is and where it was found.
+func (i *Index) Search(image image.Image, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
+	return i.SearchContext(context.Background(), image, maxResults, maxDifference, options...)
+}
+
+func (i *Index) SearchContext(ctx context.Context, image image.Image, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
 	var dummy map[string]interface{}
 
-	entry, err := NewIndexEntry(image, i.maxFingerprintSize, dummy)
+	entry, err := i.newEntry(image, dummy)
 	if err != nil {
-		return nil, nil
+		return nil, err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.search(ctx, entry, maxResults, maxDifference, newSearchOptions(options))
+}
+
+// SearchByFingerprint returns the entries most similar to the image with the
+// given max fingerprint, nearest first, along with how different each one is.
+// The fingerprint must have come from an index with the same parameters, such
+// as by UnmarshalText from the output of MarshalText, or ErrIncompatibleIndex
+// is returned.
+func (i *Index) SearchByFingerprint(f Fingerprint, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
+	return i.SearchByFingerprintContext(context.Background(), f, maxResults, maxDifference, options...)
+}
+
+func (i *Index) SearchByFingerprintContext(ctx context.Context, f Fingerprint, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
+	if f.Size() != i.maxFingerprintSize {
+		return nil, incompatibleIndex("fingerprint has size %d but the index uses max fingerprint size %d", f.Size(), i.maxFingerprintSize)
 	}
 
-	root, err := i.Store.GetRoot()
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.search(ctx, &IndexEntry{MaxFingerprint: f}, maxResults, maxDifference, newSearchOptions(options))
+}
+
+// SearchByKey returns the entries most similar to the entry with the given
+// key, nearest first, along with how different each one is, or
+// ErrEntryNotFound if there isn't one. The entry itself is among the results
+// unless excluded with ExcludingKeys.
+func (i *Index) SearchByKey(key string, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
+	return i.SearchByKeyContext(context.Background(), key, maxResults, maxDifference, options...)
+}
+
+func (i *Index) SearchByKeyContext(ctx context.Context, key string, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	entry, err := i.Store.GetEntry(ctx, key)
 	if err != nil {
 		return nil, err
+	} else if entry == nil {
+		return nil, ErrEntryNotFound
 	}
 
-	results, err := root.FindNearest(entry, rootFingerprintSize+1, i, maxResults, math.Max(maxDifference, i.maxEntryDifference))
+	return i.search(ctx, entry, maxResults, maxDifference, newSearchOptions(options))
+}
+
+// SetLogger sets the logger which receives index events, and passes it on to
+// the store if the store supports logging. Events are discarded if no logger
+// is set.
+func (i *Index) SetLogger(logger Logger) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.logger = logger
+
+	if s, ok := i.Store.(interface{ SetLogger(Logger) }); ok {
+		s.SetLogger(logger)
+	}
+}
+
+func (i *Index) UpdateAttributes(key string, patch map[string]interface{}) error {
+	return i.UpdateAttributesContext(context.Background(), key, patch)
+}
+
+func (i *Index) UpdateAttributesContext(ctx context.Context, key string, patch map[string]interface{}) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return i.Store.UpdateEntry(ctx, key, func(entry *IndexEntry) {
+		entry.Attributes = mergeAttributes(entry.Attributes, patch)
+	})
+}
+
+// addBatch adds entries which have already been fingerprinted and keyed.
+func (i *Index) addBatch(ctx context.Context, entries []*IndexEntry) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	batch := newBatchIndexStore(i.Store)
+	batchIndex := i.withStore(batch)
+
+	root, err := batch.GetRoot(ctx)
+	if err != nil {
+		return err
+	}
+
+	var rootFingerprint Fingerprint
+
+	for _, entry := range entries {
+		_, err = root.Add(ctx, entry, rootFingerprint, rootFingerprintSize+1, batchIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	nodeBatch := batch.nodeBatch(entries)
+
+	i.log().Debug("writing batch", "entries", len(entries), "nodes", len(nodeBatch.Nodes))
+
+	return i.Store.PutBatch(ctx, nodeBatch)
+}
+
+func (i *Index) search(ctx context.Context, entry *IndexEntry, maxResults int, maxDifference float64, options *searchOptions) ([]SearchResult, error) {
+	root, err := i.Store.GetRoot(ctx)
 	if err != nil {
+		options.traceEnd(SearchFailed, err)
 		return nil, err
 	}
-	sort.Sort(entriesByDifferenceToEntryWith(results, entry))
 
-	return results, err
+	var rootFingerprint Fingerprint
+
+	results, err := root.FindNearest(ctx, entry, rootFingerprint, rootFingerprintSize+1, i, maxResults, maxDifference, options)
+	if err != nil {
+		options.traceEnd(SearchFailed, err)
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (i *Index) fingerprintForSize(entry *IndexEntry, size int) Fingerprint {
+	return entry.fingerprintWith(i.fingerprintAlgorithm, size)
+}
+
+func (i *Index) log() Logger {
+	if i.logger == nil {
+		return nopLogger{}
+	}
+	return i.logger
+}
+
+// withStore returns an index with the same parameters as this one, but backed
+// by the given store.
+func (i *Index) withStore(store IndexStore) *Index {
+	return &Index{
+		Store:                   store,
+		maxFingerprintSize:      i.maxFingerprintSize,
+		maxEntryDifference:      i.maxEntryDifference,
+		thumbnailSizeMultiplier: i.thumbnailSizeMultiplier,
+		minThumbnailSize:        i.minThumbnailSize,
+		fingerprintAlgorithm:    i.fingerprintAlgorithm,
+		logger:                  i.logger,
+	}
+}
+
+func (i *Index) newEntry(image image.Image, attributes map[string]interface{}) (*IndexEntry, error) {
+	thumbnailSize := i.maxFingerprintSize * i.thumbnailSizeMultiplier
+	if i.minThumbnailSize > thumbnailSize {
+		thumbnailSize = i.minThumbnailSize
+	}
+
+	return newIndexEntry(image, i.maxFingerprintSize, thumbnailSize, i.fingerprintAlgorithm, attributes)
 }
 
+// NewIndex opens the index in the given directory, creating it if necessary.
+// If maxFingerprintSize or maxEntryDifference are zero, the values the index
+// was created with are used.
 func NewIndex(path string, maxFingerprintSize int, maxEntryDifference float64) (*Index, error) {
 	err := os.MkdirAll(path, 0700)
 	if err != nil {
-		return nil, err
+		return nil, storeFailure(err)
 	}
 
 	indexStore, err := NewDiskIndexStore(path)
@@ -76,41 +461,97 @@ func NewIndex(path string, maxFingerprintSize int, maxEntryDifference float64) (
 		return nil, err
 	}
 
-	return &Index{
-		Store:              indexStore,
-		maxFingerprintSize: maxFingerprintSize,
-		maxEntryDifference: maxEntryDifference,
-	}, err
-}
+	index, err := NewIndexWithStore(indexStore, WithMaxFingerprintSize(maxFingerprintSize), WithMaxEntryDifference(maxEntryDifference))
+	if err != nil {
+		indexStore.Close()
+		return nil, err
+	}
 
-type entriesByDifferenceToEntry struct {
-	entries     []*IndexEntry
-	differences []float64
+	return index, nil
 }
 
-func (sorter *entriesByDifferenceToEntry) Len() int {
-	return len(sorter.entries)
+// NewIndexWithStore creates an index backed by the given store. If the store
+// already contains an index, options which aren't specified take on the values
+// it was created with, and options which conflict with them are rejected with
+// ErrIncompatibleIndex. Otherwise, unspecified options take on default values.
+func NewIndexWithStore(store IndexStore, options ...IndexOption) (*Index, error) {
+	index := &Index{Store: store}
+
+	for _, option := range options {
+		option(index)
+	}
+
+	var manifest *IndexManifest
+
+	if store != nil {
+		var err error
+
+		manifest, err = store.GetManifest(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if manifest != nil {
+		err := index.applyManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+
+	} else if store != nil {
+		root, err := store.GetRoot(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		// Indexes from before manifests were introduced need to be migrated
+		if !root.isEmpty() {
+			return nil, &kindError{kind: ErrUnsupportedFormat, err: errors.New("index has no manifest and must be migrated")}
+		}
+	}
+
+	index.applyDefaults()
+
+	err := index.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest == nil {
+		err = store.PutManifest(context.Background(), index.manifest())
+		if err != nil && err != ErrReadOnly {
+			return nil, err
+		}
+	}
+
+	if index.logger != nil {
+		index.SetLogger(index.logger)
+	}
+
+	return index, nil
 }
 
-func (sorter *entriesByDifferenceToEntry) Less(i, j int) bool {
-	return sorter.differences[i] < sorter.differences[j]
+// NewMemoryIndex creates an index which is held entirely in memory by a
+// MemoryIndexStore.
+func NewMemoryIndex(maxFingerprintSize int, maxEntryDifference float64) (*Index, error) {
+	return NewIndexWithStore(NewMemoryIndexStore(), WithMaxFingerprintSize(maxFingerprintSize), WithMaxEntryDifference(maxEntryDifference))
 }
 
-func (sorter *entriesByDifferenceToEntry) Swap(i, j int) {
-	tmpEntry := sorter.entries[i]
-	sorter.entries[i] = sorter.entries[j]
-	sorter.entries[j] = tmpEntry
+func mergeAttributes(attributes map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(attributes)+len(patch))
 
-	tmpDiff := sorter.differences[i]
-	sorter.differences[i] = sorter.differences[j]
-	sorter.differences[j] = tmpDiff
-}
+	for k, v := range attributes {
+		merged[k] = v
+	}
 
-func entriesByDifferenceToEntryWith(entries []*IndexEntry, target *IndexEntry) *entriesByDifferenceToEntry {
-	differences := make([]float64, len(entries), len(entries))
-	for i, entry := range entries {
-		differences[i] = entry.MaxFingerprint.Difference(target.MaxFingerprint)
+	// A nil value in the patch removes the attribute
+	for k, v := range patch {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = copyAttributeValue(v)
+		}
 	}
 
-	return &entriesByDifferenceToEntry{entries: entries, differences: differences}
+	return merged
 }
@@ -0,0 +1,1492 @@
+package simian
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+
+	testImage := testImageWithSeed
+
+	withIndex := func(t *testing.T, action func(index *Index)) {
+		dir := t.TempDir()
+
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		defer index.Close()
+
+		action(index)
+	}
+
+	t.Run("Add()", func(t *testing.T) {
+
+		t.Run("should reject a nil image", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.Add(nil, nil)
+				if err != ErrInvalidImage {
+					t.Errorf("Expected ErrInvalidImage but got %v", err)
+				}
+			})
+		})
+
+		t.Run("should reject an image with empty bounds", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.Add(image.NewNRGBA(image.Rect(0, 0, 0, 10)), nil)
+				if !errors.Is(err, ErrEmptyBounds) {
+					t.Errorf("Expected ErrEmptyBounds but got %v", err)
+				}
+			})
+		})
+
+		t.Run("should propagate store failures while pushing entries to children", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				storeErr := errors.New("some store failure")
+				index.Store = &failingIndexStore{IndexStore: index.Store, err: storeErr}
+
+				for i := 1; i <= 20; i++ {
+					_, err := index.Add(testImage(i), nil)
+					if err == storeErr {
+						root, err := index.Store.GetRoot(context.Background())
+						if err != nil {
+							t.Fatalf("Error getting root: %v", err)
+						}
+						if len(root.entries) == 0 {
+							t.Errorf("Expected root entries to be kept after failing to push them to children")
+						}
+						return
+
+					} else if err != nil {
+						t.Fatalf("Expected store failure but got %v", err)
+					}
+				}
+
+				t.Errorf("Expected store failure to be propagated")
+			})
+		})
+	})
+
+	t.Run("AddBatch()", func(t *testing.T) {
+
+		t.Run("should find the same nearest entries as adding one at a time", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				reference, err := NewLinearIndex(WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05))
+				if err != nil {
+					t.Fatalf("Error creating reference index: %v", err)
+				}
+
+				random := rand.New(rand.NewSource(1))
+				var images []image.Image
+				for i := 0; i < 120; i++ {
+					images = append(images, randomTestImage(random))
+				}
+
+				// Add some entries beforehand, so that the batch changes
+				// existing nodes as well as creating new ones
+				for _, img := range images[:20] {
+					_, err := index.Add(img, nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+				}
+
+				var batch []BatchEntry
+				for n, img := range images[20:] {
+					batch = append(batch, BatchEntry{Image: img, Attributes: map[string]interface{}{"n": float64(n)}})
+				}
+
+				keys, err := index.AddBatch(batch)
+				if err != nil {
+					t.Fatalf("Error adding batch: %v", err)
+				}
+				if len(keys) != len(batch) {
+					t.Fatalf("Expected %d keys but got %d", len(batch), len(keys))
+				}
+
+				for n, key := range keys {
+					entry, err := index.Get(key)
+					if err != nil {
+						t.Fatalf("Error getting entry: %v", err)
+					}
+					if entry == nil || entry.Attributes["n"] != float64(n) {
+						t.Fatalf("Expected entry %d with key '%s' but got %v", n, key, entry)
+					}
+				}
+
+				for _, img := range images {
+					_, err := reference.Add(img, nil)
+					if err != nil {
+						t.Fatalf("Error adding reference entry: %v", err)
+					}
+				}
+
+				for _, img := range images[:30] {
+					results, err := index.Search(img, 5, 1.0)
+					if err != nil {
+						t.Fatalf("Error searching: %v", err)
+					}
+					want, err := reference.Search(img, 5, 1.0)
+					if err != nil {
+						t.Fatalf("Error searching reference: %v", err)
+					}
+
+					if len(results) != len(want) {
+						t.Fatalf("Expected %d results but got %d", len(want), len(results))
+					}
+					for j := range results {
+						if results[j].Difference != want[j].Difference {
+							t.Errorf("Expected result %d to have difference %v but got %v", j, want[j].Difference, results[j].Difference)
+						}
+					}
+				}
+			})
+		})
+
+		t.Run("should write each changed node once", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			store := &recordingIndexStore{IndexStore: index.Store}
+			index.Store = store
+
+			random := rand.New(rand.NewSource(1))
+			var batch []BatchEntry
+			for i := 0; i < 50; i++ {
+				batch = append(batch, BatchEntry{Image: randomTestImage(random)})
+			}
+
+			_, err = index.AddBatch(batch)
+			if err != nil {
+				t.Fatalf("Error adding batch: %v", err)
+			}
+
+			if store.writes != 0 {
+				t.Errorf("Expected no writes outside the batch but got %d", store.writes)
+			}
+			if len(store.batches) != 1 {
+				t.Fatalf("Expected 1 batch but got %d", len(store.batches))
+			}
+
+			written := make(map[string]bool)
+			for _, n := range store.batches[0].Nodes {
+				if written[n.Fingerprint.String()] {
+					t.Errorf("Expected node [%s] to be written once", n.Fingerprint.String())
+				}
+				written[n.Fingerprint.String()] = true
+			}
+			if len(written) < 2 {
+				t.Errorf("Expected the batch to split the root but got %d nodes", len(written))
+			}
+		})
+
+		t.Run("should add nothing if an entry is invalid", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.AddBatch([]BatchEntry{{Image: testImage(1)}, {Image: nil}})
+				if err != ErrInvalidImage {
+					t.Fatalf("Expected ErrInvalidImage but got %v", err)
+				}
+
+				results, err := index.FindNearest(testImage(1), 1, 1.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 0 {
+					t.Errorf("Expected no entries but got %d", len(results))
+				}
+			})
+		})
+
+		t.Run("should add nothing once the context is done", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+			for i := 1; i <= 10; i++ {
+				_, err := index.Add(testImage(i), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			index.Store = &cancellingIndexStore{IndexStore: index.Store, cancel: cancel, loadsBeforeCancel: 1}
+
+			var batch []BatchEntry
+			for i := 11; i <= 20; i++ {
+				batch = append(batch, BatchEntry{Image: testImage(i)})
+			}
+
+			_, err = index.AddBatchContext(ctx, batch)
+			if err != context.Canceled {
+				t.Fatalf("Expected context.Canceled but got %v", err)
+			}
+
+			results, err := index.FindNearest(testImage(1), 20, 1.0)
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if len(results) != 10 {
+				t.Errorf("Expected only the 10 entries added beforehand but got %d", len(results))
+			}
+		})
+	})
+
+	t.Run("FindNearest()", func(t *testing.T) {
+
+		t.Run("should reject a nil image", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.FindNearest(nil, 10, 0.1)
+				if err != ErrInvalidImage {
+					t.Errorf("Expected ErrInvalidImage but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("FindNearestToFingerprint()", func(t *testing.T) {
+
+		t.Run("should find the entries nearest to a fingerprint", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				entry, err := index.Get(keys[6])
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+
+				entries, err := index.FindNearestToFingerprint(entry.MaxFingerprint, 3, 1.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(entries) != 3 || entries[0].Key != keys[6] {
+					t.Errorf("Expected entry '%s' first but got %v", keys[6], entries)
+				}
+			})
+		})
+
+		t.Run("should reject a fingerprint of the wrong size", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.FindNearestToFingerprint(NewFingerprint(testImage(1), 4), 1, 1.0)
+				if !errors.Is(err, ErrIncompatibleIndex) {
+					t.Errorf("Expected ErrIncompatibleIndex but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("FindNearestToKey()", func(t *testing.T) {
+
+		t.Run("should find the entries nearest to an entry, leaving out excluded keys", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				entries, err := index.FindNearestToKey(keys[4], 3, 1.0, ExcludingKeys(keys[4]))
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(entries) != 3 {
+					t.Fatalf("Expected 3 entries but got %d", len(entries))
+				}
+				for _, entry := range entries {
+					if entry.Key == keys[4] {
+						t.Errorf("Expected the entry itself to be excluded")
+					}
+				}
+			})
+		})
+
+		t.Run("should report a missing entry", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.FindNearestToKey("missing", 1, 1.0)
+				if err != ErrEntryNotFound {
+					t.Errorf("Expected ErrEntryNotFound but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("FindWithin()", func(t *testing.T) {
+
+		t.Run("should find every entry within the max difference exactly once", func(t *testing.T) {
+			options := []IndexOption{WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05)}
+
+			index, err := NewIndexWithStore(NewMemoryIndexStore(), options...)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+			linear, err := NewLinearIndex(options...)
+			if err != nil {
+				t.Fatalf("Error creating linear index: %v", err)
+			}
+
+			random := rand.New(rand.NewSource(1))
+
+			var corpus []image.Image
+			for i := 0; i < 50; i++ {
+				img := randomTestImage(random)
+				corpus = append(corpus, img, perturbedTestImage(random, img), perturbedTestImage(random, img))
+			}
+
+			// Give both indexes the same keys, so that results can be compared
+			keys := make(map[string]string)
+			for _, img := range corpus {
+				key, err := index.Add(img, nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+				linearKey, err := linear.Add(img, nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+				keys[linearKey] = key
+			}
+
+			for _, maxDifference := range []float64{0.0, 0.05, 0.2} {
+				for _, query := range corpus[:30] {
+					expected := make(map[string]float64)
+					linear.FindWithin(query, maxDifference, func(result SearchResult) bool {
+						expected[keys[result.Key]] = result.Difference
+						return true
+					})
+
+					found := make(map[string]bool)
+					err := index.FindWithin(query, maxDifference, func(result SearchResult) bool {
+						if found[result.Key] {
+							t.Errorf("Expected entry '%s' to be found only once", result.Key)
+						}
+						found[result.Key] = true
+
+						if diff, ok := expected[result.Key]; !ok || diff != result.Difference {
+							t.Errorf("Expected only entries within %v but got '%s' with difference %v", maxDifference, result.Key, result.Difference)
+						}
+						return true
+					})
+					if err != nil {
+						t.Fatalf("Error searching: %v", err)
+					}
+
+					if len(found) != len(expected) {
+						t.Errorf("Expected %d entries within %v but got %d", len(expected), maxDifference, len(found))
+					}
+				}
+			}
+		})
+
+		t.Run("should skip children which are too far away", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 100; i++ {
+				_, err := index.Add(randomTestImage(random), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			logger := &recordingLogger{}
+			index.SetLogger(logger)
+
+			err = index.FindWithin(randomTestImage(random), 0.01, func(SearchResult) bool { return true })
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+
+			visited := 0
+			for _, event := range logger.events {
+				if event.msg == "visiting node" {
+					visited++
+				}
+			}
+
+			if nodes := len(index.Store.(*MemoryIndexStore).nodes); visited >= nodes {
+				t.Errorf("Expected fewer than all %d nodes to be visited but %d were", nodes, visited)
+			}
+		})
+
+		t.Run("should stop when the function returns false", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				for i := 1; i <= 20; i++ {
+					_, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+				}
+
+				calls := 0
+				err := index.FindWithin(testImage(1), 1.0, func(result SearchResult) bool {
+					calls++
+					return calls < 3
+				})
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if calls != 3 {
+					t.Errorf("Expected 3 calls but got %d", calls)
+				}
+			})
+		})
+
+		t.Run("should reject a nil image", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				err := index.FindWithin(nil, 0.1, func(SearchResult) bool { return true })
+				if err != ErrInvalidImage {
+					t.Errorf("Expected ErrInvalidImage but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("Get()", func(t *testing.T) {
+
+		t.Run("should return the entry added with a key", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), map[string]interface{}{"seed": float64(i)})
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				for i, key := range keys {
+					entry, err := index.Get(key)
+					if err != nil {
+						t.Fatalf("Error getting entry: %v", err)
+					}
+					if entry == nil {
+						t.Fatalf("Expected entry for key '%s' but got none", key)
+					}
+					if entry.Key != key {
+						t.Errorf("Expected key '%s' but got '%s'", key, entry.Key)
+					}
+					if actual, expected := entry.Attributes["seed"], float64(i+1); actual != expected {
+						t.Errorf("Expected attribute %v but got %v", expected, actual)
+					}
+					if entry.Thumbnail == nil {
+						t.Errorf("Expected thumbnail to be loaded")
+					}
+				}
+			})
+		})
+
+		t.Run("should return nil for an unknown key", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				entry, err := index.Get("nonexistent")
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+				if entry != nil {
+					t.Errorf("Expected no entry but got %v", entry)
+				}
+			})
+		})
+	})
+	t.Run("IndexAttributes()", func(t *testing.T) {
+
+		t.Run("should find entries by indexed attributes", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key, err := index.Add(testImage(1), map[string]interface{}{"source": "upload"})
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+				_, err = index.Add(testImage(2), map[string]interface{}{"source": "crawl"})
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				err = index.IndexAttributes("source")
+				if err != nil {
+					t.Fatalf("Error indexing attributes: %v", err)
+				}
+
+				keys, err := index.KeysWithAttribute("source", "upload")
+				if err != nil {
+					t.Fatalf("Error finding keys: %v", err)
+				}
+				if len(keys) != 1 || keys[0] != key {
+					t.Errorf("Expected key '%s' but got %v", key, keys)
+				}
+			})
+		})
+
+		t.Run("should report stores which can't index attributes", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			err = index.IndexAttributes("source")
+			if err != ErrAttributesUnsupported {
+				t.Errorf("Expected ErrAttributesUnsupported but got %v", err)
+			}
+
+			_, err = index.KeysWithAttribute("source", "upload")
+			if err != ErrAttributesUnsupported {
+				t.Errorf("Expected ErrAttributesUnsupported but got %v", err)
+			}
+		})
+	})
+
+	t.Run("Remove()", func(t *testing.T) {
+
+		t.Run("should remove the entry and its thumbnail", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key, err := index.Add(testImage(1), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				entry, err := index.Get(key)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+				thumbnailPath := index.Store.(*DiskIndexStore).pathForThumbnail(entry)
+
+				err = index.Remove(key)
+				if err != nil {
+					t.Fatalf("Error removing entry: %v", err)
+				}
+
+				entry, err = index.Get(key)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+				if entry != nil {
+					t.Errorf("Expected entry to be removed but got %v", entry)
+				}
+				if _, err := os.Stat(thumbnailPath); !os.IsNotExist(err) {
+					t.Errorf("Expected thumbnail to be deleted but got %v", err)
+				}
+			})
+		})
+
+		t.Run("should leave other entries with the same image intact", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key1, err := index.Add(testImage(1), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+				key2, err := index.Add(testImage(1), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				err = index.Remove(key1)
+				if err != nil {
+					t.Fatalf("Error removing entry: %v", err)
+				}
+
+				entry, err := index.Get(key2)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+				if entry == nil || entry.Thumbnail == nil {
+					t.Errorf("Expected remaining entry with thumbnail but got %v", entry)
+				}
+			})
+		})
+
+		t.Run("should prune children left empty", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				root, err := index.Store.GetRoot(context.Background())
+				if err != nil {
+					t.Fatalf("Error getting root: %v", err)
+				}
+				if len(root.childFingerprints) == 0 {
+					t.Fatalf("Expected root to have been split into children")
+				}
+
+				for _, key := range keys {
+					err := index.Remove(key)
+					if err != nil {
+						t.Fatalf("Error removing entry: %v", err)
+					}
+				}
+
+				root, err = index.Store.GetRoot(context.Background())
+				if err != nil {
+					t.Fatalf("Error getting root: %v", err)
+				}
+				if !root.isEmpty() {
+					t.Errorf("Expected empty root but got %d children and %d entries", len(root.childFingerprints), len(root.entries))
+				}
+			})
+		})
+
+		t.Run("should do nothing for an unknown key", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				err := index.Remove("nonexistent")
+				if err != nil {
+					t.Errorf("Expected no error but got %v", err)
+				}
+			})
+		})
+	})
+	t.Run("UpdateAttributes()", func(t *testing.T) {
+
+		t.Run("should merge attributes and remove nil values", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key, err := index.Add(testImage(1), map[string]interface{}{"owner": "alice", "status": "pending", "tag": "cat"})
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				err = index.UpdateAttributes(key, map[string]interface{}{"status": "approved", "tag": nil, "score": 5.0})
+				if err != nil {
+					t.Fatalf("Error updating attributes: %v", err)
+				}
+
+				entry, err := index.Get(key)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+
+				expected := map[string]interface{}{"owner": "alice", "status": "approved", "score": 5.0}
+				if !reflect.DeepEqual(entry.Attributes, expected) {
+					t.Errorf("Expected attributes %v but got %v", expected, entry.Attributes)
+				}
+			})
+		})
+
+		t.Run("should fail for an unknown key", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				err := index.UpdateAttributes("nonexistent", map[string]interface{}{"a": "b"})
+				if err != ErrEntryNotFound {
+					t.Errorf("Expected ErrEntryNotFound but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("ReplaceAttributes()", func(t *testing.T) {
+
+		t.Run("should replace all attributes", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key, err := index.Add(testImage(1), map[string]interface{}{"owner": "alice", "status": "pending"})
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				err = index.ReplaceAttributes(key, map[string]interface{}{"owner": "bob"})
+				if err != nil {
+					t.Fatalf("Error replacing attributes: %v", err)
+				}
+
+				entry, err := index.Get(key)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+
+				expected := map[string]interface{}{"owner": "bob"}
+				if !reflect.DeepEqual(entry.Attributes, expected) {
+					t.Errorf("Expected attributes %v but got %v", expected, entry.Attributes)
+				}
+			})
+		})
+	})
+	t.Run("Search()", func(t *testing.T) {
+
+		t.Run("should return results with their differences in nearest first order", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				keys := make(map[string]bool)
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys[key] = true
+				}
+
+				query, err := NewIndexEntry(testImage(3), 8, nil)
+				if err != nil {
+					t.Fatalf("Error creating entry: %v", err)
+				}
+
+				results, err := index.Search(testImage(3), 10, 1.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) == 0 {
+					t.Fatalf("Expected results but got none")
+				}
+
+				for j, result := range results {
+					if result.Entry == nil || result.Key != result.Entry.Key || !keys[result.Key] {
+						t.Errorf("Expected result %d to have a key for an added entry but got %+v", j, result)
+					}
+					if expected := result.Entry.MaxFingerprint.Difference(query.MaxFingerprint); result.Difference != expected {
+						t.Errorf("Expected result %d to have difference %v but got %v", j, expected, result.Difference)
+					}
+					if result.Depth > 0 && result.NodeFingerprint.Size() != rootFingerprintSize+result.Depth {
+						t.Errorf("Expected result %d at depth %d to be from a node with fingerprint size %d but got %d", j, result.Depth, rootFingerprintSize+result.Depth, result.NodeFingerprint.Size())
+					}
+					if j > 0 && results[j-1].Difference > result.Difference {
+						t.Errorf("Expected results to be sorted by difference but %v came before %v", results[j-1].Difference, result.Difference)
+					}
+				}
+			})
+		})
+		t.Run("should find the same entries as FindWithin for a max difference below the max entry difference", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			random := rand.New(rand.NewSource(1))
+
+			var corpus []image.Image
+			for i := 0; i < 30; i++ {
+				img := randomTestImage(random)
+				corpus = append(corpus, img, perturbedTestImage(random, img), perturbedTestImage(random, img))
+			}
+			for _, img := range corpus {
+				_, err := index.Add(img, nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			maxDifference := 0.01
+
+			for _, query := range corpus {
+				expected := make(map[string]bool)
+				err := index.FindWithin(query, maxDifference, func(result SearchResult) bool {
+					expected[result.Key] = true
+					return true
+				})
+				if err != nil {
+					t.Fatalf("Error finding entries: %v", err)
+				}
+
+				results, err := index.Search(query, len(corpus), maxDifference)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+
+				for _, result := range results {
+					if !expected[result.Key] {
+						t.Errorf("Expected only entries within %v but got '%s' with difference %v", maxDifference, result.Key, result.Difference)
+					}
+				}
+				if len(results) != len(expected) {
+					t.Errorf("Expected %d entries within %v but got %d", len(expected), maxDifference, len(results))
+				}
+			}
+		})
+
+		t.Run("should stop at the node limit and report that results were truncated", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			random := rand.New(rand.NewSource(1))
+			for i := 0; i < 100; i++ {
+				_, err := index.Add(randomTestImage(random), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			query := randomTestImage(random)
+
+			var exactStats SearchStats
+			exact, err := index.Search(query, 10, 1.0, RecordingStats(&exactStats))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if exactStats.Truncated {
+				t.Errorf("Expected unlimited search not to be truncated")
+			}
+			if exactStats.NodesVisited <= 3 {
+				t.Fatalf("Expected unlimited search to visit more than 3 nodes but visited %d", exactStats.NodesVisited)
+			}
+
+			var stats SearchStats
+			results, err := index.Search(query, 10, 1.0, LimitingNodesVisited(3), RecordingStats(&stats))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if !stats.Truncated || stats.NodesVisited != 3 {
+				t.Errorf("Expected search to be truncated after 3 nodes but got %+v", stats)
+			}
+
+			for j, result := range results {
+				if j < len(exact) && result.Difference < exact[j].Difference {
+					t.Errorf("Expected truncated result %d to be no nearer than the exact one but got %v < %v", j, result.Difference, exact[j].Difference)
+				}
+				if j > 0 && results[j-1].Difference > result.Difference {
+					t.Errorf("Expected truncated results to be sorted by difference")
+				}
+			}
+
+			err = index.FindWithin(query, 1.0, func(SearchResult) bool { return true }, LimitingNodesVisited(3), RecordingStats(&stats))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if !stats.Truncated || stats.NodesVisited != 3 {
+				t.Errorf("Expected range search to be truncated after 3 nodes but got %+v", stats)
+			}
+		})
+
+		t.Run("should not report truncation when the node limit isn't needed", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.Add(testImage(1), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				var stats SearchStats
+				_, err = index.Search(testImage(1), 1, 0.0, LimitingNodesVisited(1), RecordingStats(&stats))
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if stats.Truncated || stats.NodesVisited != 1 || stats.EntriesCompared != 1 {
+					t.Errorf("Expected a complete search of the root but got %+v", stats)
+				}
+			})
+		})
+
+		t.Run("should find an entry in an index with only one entry", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key, err := index.Add(testImage(1), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				results, err := index.Search(testImage(1), 1, 0.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 1 || results[0].Key != key || results[0].Depth != 0 {
+					t.Errorf("Expected root entry with key '%s' but got %+v", key, results)
+				}
+			})
+		})
+
+		t.Run("should find the same nearest entries as a brute force search", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			for i := 1; i <= 200; i++ {
+				_, err := index.Add(testImage(i*7), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			store := index.Store.(*MemoryIndexStore)
+
+			for _, seed := range []int{3, 50, 99, 140, 701, 1000} {
+				query, err := index.newEntry(testImage(seed), nil)
+				if err != nil {
+					t.Fatalf("Error creating entry: %v", err)
+				}
+
+				var expected []float64
+				for _, node := range store.nodes {
+					for _, entry := range node.entries {
+						expected = append(expected, entry.MaxFingerprint.Difference(query.MaxFingerprint))
+					}
+				}
+				sort.Float64s(expected)
+
+				for _, maxResults := range []int{1, 5, 20} {
+					for _, maxDifference := range []float64{0.05, 0.2, 1.0} {
+						results, err := index.Search(testImage(seed), maxResults, maxDifference)
+						if err != nil {
+							t.Fatalf("Error searching: %v", err)
+						}
+
+						var want []float64
+						for _, diff := range expected {
+							if diff <= maxDifference && len(want) < maxResults {
+								want = append(want, diff)
+							}
+						}
+
+						if len(results) != len(want) {
+							t.Fatalf("Expected %d results for seed %d, max results %d, max difference %v but got %d", len(want), seed, maxResults, maxDifference, len(results))
+						}
+						for j, result := range results {
+							if result.Difference != want[j] {
+								t.Errorf("Expected result %d for seed %d, max results %d, max difference %v to have difference %v but got %v", j, seed, maxResults, maxDifference, want[j], result.Difference)
+							}
+						}
+					}
+				}
+			}
+		})
+	})
+
+	t.Run("SearchByFingerprint()", func(t *testing.T) {
+
+		t.Run("should find entries from a fingerprint in text form", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var key string
+				for i := 1; i <= 20; i++ {
+					k, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					if i == 7 {
+						key = k
+					}
+				}
+
+				entry, err := index.Get(key)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+
+				text, err := entry.MaxFingerprint.MarshalText()
+				if err != nil {
+					t.Fatalf("Error marshalling fingerprint: %v", err)
+				}
+
+				var f Fingerprint
+				err = f.UnmarshalText(text)
+				if err != nil {
+					t.Fatalf("Error unmarshalling fingerprint: %v", err)
+				}
+
+				results, err := index.SearchByFingerprint(f, 1, 0.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 1 || results[0].Difference != 0 || !reflect.DeepEqual(results[0].Entry.MaxFingerprint, entry.MaxFingerprint) {
+					t.Errorf("Expected an exact match for the fingerprint but got %+v", results)
+				}
+			})
+		})
+
+		t.Run("should reject a fingerprint of the wrong size", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.SearchByFingerprint(NewFingerprint(testImage(1), 4), 1, 0.0)
+				if !errors.Is(err, ErrIncompatibleIndex) {
+					t.Errorf("Expected ErrIncompatibleIndex but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("SearchByKey()", func(t *testing.T) {
+
+		t.Run("should find the entry itself and its neighbours", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				results, err := index.SearchByKey(keys[4], 3, 1.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 3 || results[0].Key != keys[4] || results[0].Difference != 0 {
+					t.Errorf("Expected the entry itself first but got %+v", results)
+				}
+			})
+		})
+
+		t.Run("should leave out excluded keys", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				results, err := index.SearchByKey(keys[4], 3, 1.0, ExcludingKeys(keys[4]))
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 3 {
+					t.Fatalf("Expected 3 results but got %d", len(results))
+				}
+				for _, result := range results {
+					if result.Key == keys[4] {
+						t.Errorf("Expected the entry itself to be excluded")
+					}
+				}
+			})
+		})
+
+		t.Run("should only count entries with matching attributes towards the max results", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), map[string]interface{}{"n": i, "even": i%2 == 0})
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				err := index.UpdateAttributes(keys[5], map[string]interface{}{"even": nil})
+				if err != nil {
+					t.Fatalf("Error updating attributes: %v", err)
+				}
+
+				results, err := index.SearchByKey(keys[0], 5, 1.0, MatchingAttributes(AttributeEquals("even", true), AttributeInRange("n", 1, 14)))
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 5 {
+					t.Fatalf("Expected 5 results but got %d", len(results))
+				}
+				for _, result := range results {
+					if result.Key == keys[5] {
+						t.Errorf("Expected entry without the attribute to be left out")
+					}
+					if result.Entry.Attributes["even"] != true || result.Entry.Attributes["n"].(float64) > 14 {
+						t.Errorf("Expected only matching entries but got %v", result.Entry.Attributes)
+					}
+				}
+			})
+		})
+
+		t.Run("should fail for an unknown key", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				_, err := index.SearchByKey("nonexistent", 3, 1.0)
+				if err != ErrEntryNotFound {
+					t.Errorf("Expected ErrEntryNotFound but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("with a context", func(t *testing.T) {
+
+		t.Run("should not add an entry once the context is done", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				_, err := index.AddContext(ctx, testImage(1), nil)
+				if err != context.Canceled {
+					t.Fatalf("Expected context.Canceled but got %v", err)
+				}
+
+				results, err := index.FindNearest(testImage(1), 1, 1.0)
+				if err != nil {
+					t.Fatalf("Error searching: %v", err)
+				}
+				if len(results) != 0 {
+					t.Errorf("Expected no entries but got %d", len(results))
+				}
+			})
+		})
+
+		t.Run("should finish adding an entry once the index has started changing", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+			for i := 1; i <= 20; i++ {
+				_, err := index.Add(testImage(i), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			store := &cancellingIndexStore{IndexStore: index.Store, cancel: cancel, createsBeforeCancel: 1}
+			index.Store = store
+
+			key, err := index.AddContext(ctx, testImage(21), nil)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+			if store.creates < 2 {
+				t.Fatalf("Expected the entry to be added below the root but got %d child creations", store.creates)
+			}
+
+			entry, err := index.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if entry == nil {
+				t.Errorf("Expected entry '%s' to have been added", key)
+			}
+		})
+
+		t.Run("should finish removing an entry once the index has started changing", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				var keys []string
+				for i := 1; i <= 20; i++ {
+					key, err := index.Add(testImage(i), nil)
+					if err != nil {
+						t.Fatalf("Error adding entry: %v", err)
+					}
+					keys = append(keys, key)
+				}
+
+				diskStore := index.Store
+
+				for _, key := range keys {
+					ctx, cancel := context.WithCancel(context.Background())
+					index.Store = &cancellingIndexStore{IndexStore: diskStore, cancel: cancel, removesBeforeCancel: 1}
+
+					err := index.RemoveContext(ctx, key)
+					if err != nil {
+						t.Fatalf("Error removing entry: %v", err)
+					}
+				}
+
+				index.Store = diskStore
+
+				for _, key := range keys {
+					entry, err := index.Get(key)
+					if err != nil {
+						t.Fatalf("Error getting entry: %v", err)
+					}
+					if entry != nil {
+						t.Errorf("Expected entry '%s' to have been removed", key)
+					}
+				}
+
+				root, err := index.Store.GetRoot(context.Background())
+				if err != nil {
+					t.Fatalf("Error getting root: %v", err)
+				}
+				if len(root.childFingerprints) != 0 {
+					t.Errorf("Expected empty children to be pruned but root has %d", len(root.childFingerprints))
+				}
+			})
+		})
+
+		t.Run("should stop a search between node loads", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+			for i := 1; i <= 20; i++ {
+				_, err := index.Add(testImage(i), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			store := &cancellingIndexStore{IndexStore: index.Store, cancel: cancel, loadsBeforeCancel: 2}
+			index.Store = store
+
+			_, err = index.SearchContext(ctx, testImage(1), 20, 1.0)
+			if err != context.Canceled {
+				t.Fatalf("Expected context.Canceled but got %v", err)
+			}
+			if store.loads != 2 {
+				t.Errorf("Expected search to stop after 2 node loads but got %d", store.loads)
+			}
+
+			err = index.FindWithinContext(ctx, testImage(1), 1.0, func(SearchResult) bool { return true })
+			if err != context.Canceled {
+				t.Errorf("Expected context.Canceled but got %v", err)
+			}
+		})
+
+		t.Run("should pass deadlines on to the store", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				key, err := index.Add(testImage(1), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+
+				ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+				defer cancel()
+
+				_, err = index.GetContext(ctx, key)
+				if err != context.DeadlineExceeded {
+					t.Errorf("Expected context.DeadlineExceeded but got %v", err)
+				}
+			})
+		})
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+
+		t.Run("should support concurrent additions, searches and removals", func(t *testing.T) {
+			withIndex(t, func(index *Index) {
+				const workers = 8
+				const iterations = 10
+
+				var wg sync.WaitGroup
+				errs := make(chan error, workers*iterations*5)
+				keptKeys := make(chan string, workers*iterations)
+
+				for w := 0; w < workers; w++ {
+					wg.Add(1)
+
+					go func(w int) {
+						defer wg.Done()
+
+						for i := 0; i < iterations; i++ {
+							img := testImage(w*iterations + i + 1)
+
+							key, err := index.Add(img, map[string]interface{}{"worker": float64(w)})
+							if err != nil {
+								errs <- err
+								continue
+							}
+
+							_, err = index.FindNearest(img, 5, 0.2)
+							if err != nil {
+								errs <- err
+							}
+
+							_, err = index.Get(key)
+							if err != nil {
+								errs <- err
+							}
+
+							if i%2 == 0 {
+								err = index.Remove(key)
+								if err != nil {
+									errs <- err
+								}
+							} else {
+								err = index.UpdateAttributes(key, map[string]interface{}{"iteration": float64(i)})
+								if err != nil {
+									errs <- err
+								}
+								keptKeys <- key
+							}
+						}
+					}(w)
+				}
+
+				wg.Wait()
+				close(errs)
+				close(keptKeys)
+
+				for err := range errs {
+					t.Errorf("Error during concurrent use: %v", err)
+				}
+
+				for key := range keptKeys {
+					entry, err := index.Get(key)
+					if err != nil {
+						t.Fatalf("Error getting entry: %v", err)
+					}
+					if entry == nil {
+						t.Errorf("Expected entry for key '%s' to remain", key)
+					} else if _, ok := entry.Attributes["iteration"]; !ok {
+						t.Errorf("Expected updated attributes for key '%s' but got %v", key, entry.Attributes)
+					}
+				}
+			})
+		})
+	})
+}
+
+// failingIndexStore fails to add entries anywhere but the root node, so that
+// the first failure happens while the root is being split.
+type failingIndexStore struct {
+	IndexStore
+	err error
+}
+
+func (s *failingIndexStore) AddEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	if len(nodeFingerprint.samples) > 0 {
+		return s.err
+	}
+
+	return s.IndexStore.AddEntry(ctx, entry, node, nodeFingerprint)
+}
+
+type cancellingIndexStore struct {
+	IndexStore
+	cancel              context.CancelFunc
+	loads               int
+	loadsBeforeCancel   int
+	creates             int
+	createsBeforeCancel int
+	removes             int
+	removesBeforeCancel int
+}
+
+func (s *cancellingIndexStore) GetChild(ctx context.Context, f Fingerprint, parent *IndexNode) (*IndexNode, error) {
+	s.loads++
+	if s.loads == s.loadsBeforeCancel {
+		s.cancel()
+	}
+
+	return s.IndexStore.GetChild(ctx, f, parent)
+}
+
+func (s *cancellingIndexStore) GetOrCreateChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error) {
+	s.creates++
+	if s.creates == s.createsBeforeCancel {
+		s.cancel()
+	}
+
+	return s.IndexStore.GetOrCreateChild(ctx, f, parent, parentFingerprint)
+}
+
+func (s *cancellingIndexStore) RemoveEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	err := s.IndexStore.RemoveEntry(ctx, entry, node, nodeFingerprint)
+
+	s.removes++
+	if s.removes == s.removesBeforeCancel {
+		s.cancel()
+	}
+
+	return err
+}
+
+// recordingIndexStore records the batches written to it, and counts the
+// other writes.
+type recordingIndexStore struct {
+	IndexStore
+	batches []*NodeBatch
+	writes  int
+}
+
+func (s *recordingIndexStore) AddEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	s.writes++
+	return s.IndexStore.AddEntry(ctx, entry, node, nodeFingerprint)
+}
+
+func (s *recordingIndexStore) ExpandChildBounds(ctx context.Context, f Fingerprint, entryFingerprint Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	s.writes++
+	return s.IndexStore.ExpandChildBounds(ctx, f, entryFingerprint, parent, parentFingerprint)
+}
+
+func (s *recordingIndexStore) GetOrCreateChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error) {
+	s.writes++
+	return s.IndexStore.GetOrCreateChild(ctx, f, parent, parentFingerprint)
+}
+
+func (s *recordingIndexStore) PutBatch(ctx context.Context, batch *NodeBatch) error {
+	s.batches = append(s.batches, batch)
+	return s.IndexStore.PutBatch(ctx, batch)
+}
+
+func (s *recordingIndexStore) RemoveEntries(ctx context.Context, node *IndexNode, nodeFingerprint Fingerprint) error {
+	s.writes++
+	return s.IndexStore.RemoveEntries(ctx, node, nodeFingerprint)
+}
+
+func BenchmarkIndex(b *testing.B) {
+
+	withBenchmarkIndex := func(b *testing.B, action func(index *Index, images []image.Image)) {
+		dir := b.TempDir()
+
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			b.Fatalf("Error creating index: %v", err)
+		}
+		defer index.Close()
+
+		random := rand.New(rand.NewSource(1))
+		images := make([]image.Image, b.N)
+		for i := range images {
+			images[i] = randomTestImage(random)
+		}
+
+		b.ResetTimer()
+		action(index, images)
+		b.StopTimer()
+
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "entries/s")
+	}
+
+	b.Run("Add", func(b *testing.B) {
+		withBenchmarkIndex(b, func(index *Index, images []image.Image) {
+			for _, img := range images {
+				_, err := index.Add(img, nil)
+				if err != nil {
+					b.Fatalf("Error adding entry: %v", err)
+				}
+			}
+		})
+	})
+
+	b.Run("AddBatch", func(b *testing.B) {
+		const batchSize = 500
+
+		withBenchmarkIndex(b, func(index *Index, images []image.Image) {
+			for start := 0; start < len(images); start += batchSize {
+				end := start + batchSize
+				if end > len(images) {
+					end = len(images)
+				}
+
+				batch := make([]BatchEntry, 0, end-start)
+				for _, img := range images[start:end] {
+					batch = append(batch, BatchEntry{Image: img})
+				}
+
+				_, err := index.AddBatch(batch)
+				if err != nil {
+					b.Fatalf("Error adding batch: %v", err)
+				}
+			}
+		})
+	})
+}
+
+func testImageWithSeed(seed int) image.Image {
+	img := image.NewNRGBA(image.Rectangle{Max: image.Point{X: 64, Y: 64}})
+
+	for i := img.Bounds().Min.Y; i < img.Bounds().Max.Y; i++ {
+		for j := img.Bounds().Min.X; j < img.Bounds().Max.X; j++ {
+			v := uint8((i*seed + j*(seed+3)) % 256)
+			img.Set(j, i, color.RGBA{v, v, v, 255})
+		}
+	}
+
+	return img
+}
@@ -0,0 +1,190 @@
+package simian
+
+import (
+	"context"
+	"errors"
+	"image"
+)
+
+var errNotBatched = errors.New("operation is not supported within a batch")
+
+// BatchEntry is an image to be added by AddBatch, with its attributes.
+type BatchEntry struct {
+	Image      image.Image
+	Attributes map[string]interface{}
+}
+
+// NodeBatch holds the changes made to an index by adding a batch of entries,
+// so that a store can write each node changed by the batch once.
+type NodeBatch struct {
+	// Entries are the entries added by the batch.
+	Entries []*IndexEntry
+
+	// EntryLocations are the fingerprints of the nodes holding each entry
+	// added or moved by the batch, by key.
+	EntryLocations map[string]Fingerprint
+
+	// Nodes are the nodes created or changed by the batch, in the order they
+	// were first changed.
+	Nodes []BatchNode
+}
+
+// BatchNode is a node created or changed by a batch.
+type BatchNode struct {
+	Fingerprint Fingerprint
+	Node        *IndexNode
+}
+
+// batchIndexStore makes the changes for a batch of entries to copies of the
+// nodes of an underlying store, so that nothing is written to the underlying
+// store until the whole batch has been added. Only the operations needed to
+// add entries are supported.
+type batchIndexStore struct {
+	store          IndexStore
+	nodes          map[string]*IndexNode
+	changed        map[string]bool
+	changedNodes   []BatchNode
+	entryLocations map[string]Fingerprint
+}
+
+func (s *batchIndexStore) AddEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	node.registerEntry(entry)
+	s.markChanged(nodeFingerprint, node)
+	s.entryLocations[entry.Key] = nodeFingerprint
+
+	return nil
+}
+
+func (s *batchIndexStore) Close() error {
+	return nil
+}
+
+func (s *batchIndexStore) ExpandChildBounds(ctx context.Context, f Fingerprint, entryFingerprint Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	if parent.expandChildBounds(f, entryFingerprint) {
+		s.markChanged(parentFingerprint, parent)
+	}
+
+	return nil
+}
+
+func (s *batchIndexStore) GetChild(ctx context.Context, f Fingerprint, parent *IndexNode) (*IndexNode, error) {
+	if node, ok := s.nodes[f.String()]; ok {
+		return node, nil
+	}
+
+	node, err := s.store.GetChild(ctx, f, parent)
+	if err != nil || node == nil {
+		return nil, err
+	}
+
+	node = node.clone()
+	s.nodes[f.String()] = node
+
+	return node, nil
+}
+
+func (s *batchIndexStore) GetEntry(ctx context.Context, key string) (*IndexEntry, error) {
+	return s.store.GetEntry(ctx, key)
+}
+
+func (s *batchIndexStore) GetManifest(ctx context.Context) (*IndexManifest, error) {
+	return s.store.GetManifest(ctx)
+}
+
+func (s *batchIndexStore) GetOrCreateChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error) {
+	node, err := s.GetChild(ctx, f, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, registered := parent.childFingerprintsByString[f.String()]; node != nil && registered {
+		return node, nil
+	}
+
+	if node == nil {
+		node = &IndexNode{
+			childFingerprintsByString: make(map[string]*Fingerprint),
+		}
+		s.nodes[f.String()] = node
+	}
+
+	node.parentCount++
+	s.markChanged(f, node)
+
+	parent.registerChild(f)
+	s.markChanged(parentFingerprint, parent)
+
+	return node, nil
+}
+
+func (s *batchIndexStore) GetRoot(ctx context.Context) (*IndexNode, error) {
+	var rootFingerprint Fingerprint
+
+	if root, ok := s.nodes[rootFingerprint.String()]; ok {
+		return root, nil
+	}
+
+	root, err := s.store.GetRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	root = root.clone()
+	s.nodes[rootFingerprint.String()] = root
+
+	return root, nil
+}
+
+func (s *batchIndexStore) PutManifest(ctx context.Context, manifest *IndexManifest) error {
+	return errNotBatched
+}
+
+func (s *batchIndexStore) PutBatch(ctx context.Context, batch *NodeBatch) error {
+	return errNotBatched
+}
+
+func (s *batchIndexStore) RemoveChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	return errNotBatched
+}
+
+func (s *batchIndexStore) RemoveEntries(ctx context.Context, node *IndexNode, nodeFingerprint Fingerprint) error {
+	node.removeEntries()
+	s.markChanged(nodeFingerprint, node)
+
+	return nil
+}
+
+func (s *batchIndexStore) RemoveEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	return errNotBatched
+}
+
+func (s *batchIndexStore) UpdateEntry(ctx context.Context, key string, update func(entry *IndexEntry)) error {
+	return errNotBatched
+}
+
+func (s *batchIndexStore) markChanged(f Fingerprint, node *IndexNode) {
+	if s.changed[f.String()] {
+		return
+	}
+
+	s.changed[f.String()] = true
+	s.changedNodes = append(s.changedNodes, BatchNode{Fingerprint: f, Node: node})
+}
+
+// nodeBatch returns the changes made for the given entries.
+func (s *batchIndexStore) nodeBatch(entries []*IndexEntry) *NodeBatch {
+	return &NodeBatch{
+		Entries:        entries,
+		EntryLocations: s.entryLocations,
+		Nodes:          s.changedNodes,
+	}
+}
+
+func newBatchIndexStore(store IndexStore) *batchIndexStore {
+	return &batchIndexStore{
+		store:          store,
+		nodes:          make(map[string]*IndexNode),
+		changed:        make(map[string]bool),
+		entryLocations: make(map[string]Fingerprint),
+	}
+}
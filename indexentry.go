@@ -1,18 +1,28 @@
 package simian
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"image"
 	"image/png"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/image/draw"
 )
 
 const keyBitLength = 256
 
+// Thumbnails are never more than this many times longer than they are wide
+// (or vice versa), so that banner-like images don't produce huge thumbnails.
+const maxThumbnailAspectRatio = 16
+
 type IndexEntry struct {
+	Key            string
 	Thumbnail      image.Image
 	MaxFingerprint Fingerprint
 	Attributes     map[string]interface{}
@@ -24,6 +34,7 @@ func (entry *IndexEntry) FingerprintForSize(size int) Fingerprint {
 
 func (entry *IndexEntry) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&indexEntryJSON{
+		Key:            entry.Key,
 		MaxFingerprint: entry.MaxFingerprint.Bytes(),
 		Attributes:     entry.Attributes,
 	})
@@ -31,7 +42,7 @@ func (entry *IndexEntry) MarshalJSON() ([]byte, error) {
 
 func (entry *IndexEntry) UnmarshalJSON(b []byte) error {
 	var value indexEntryJSON
-	err := json.Unmarshal(b, &value)
+	err := decodeJSONNumbers(b, &value)
 	if err != nil {
 		return err
 	}
@@ -42,12 +53,25 @@ func (entry *IndexEntry) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	entry.Key = value.Key
 	entry.MaxFingerprint = fingerprint
-	entry.Attributes = value.Attributes
+	entry.Attributes = exactAttributeNumbers(value.Attributes)
 
 	return nil
 }
 
+// copy returns a copy of the entry whose attributes can be changed without
+// affecting the original. The thumbnail is shared, since it's never changed.
+func (entry *IndexEntry) copy() *IndexEntry {
+	entryCopy := *entry
+	entryCopy.Attributes = copyAttributes(entry.Attributes)
+	return &entryCopy
+}
+
+func (entry *IndexEntry) fingerprintWith(algorithm FingerprintAlgorithm, size int) Fingerprint {
+	return algorithm.Fingerprint(entry.Thumbnail, size)
+}
+
 func (entry *IndexEntry) loadThumbnail(path string) error {
 	thumbnailFile, err := os.Open(path)
 	if err != nil {
@@ -61,7 +85,10 @@ func (entry *IndexEntry) loadThumbnail(path string) error {
 
 func (entry *IndexEntry) saveThumbnail(path string) error {
 	thumbnailDir := filepath.Dir(path)
-	os.MkdirAll(thumbnailDir, os.FileMode(0700))
+	err := os.MkdirAll(thumbnailDir, os.FileMode(0700))
+	if err != nil {
+		return err
+	}
 
 	thumbnailOut, err := os.Create(path)
 	if err != nil {
@@ -74,26 +101,96 @@ func (entry *IndexEntry) saveThumbnail(path string) error {
 }
 
 func NewIndexEntry(image image.Image, maxFingerprintSize int, attributes map[string]interface{}) (*IndexEntry, error) {
-	entry := &IndexEntry{
-		Thumbnail:  makeThumbnail(image, maxFingerprintSize*2),
-		Attributes: attributes,
+	return newIndexEntry(image, maxFingerprintSize, maxFingerprintSize*defaultThumbnailSizeMultiplier, LuminanceFingerprintAlgorithm{}, attributes)
+}
+
+func copyAttributes(attributes map[string]interface{}) map[string]interface{} {
+	if attributes == nil {
+		return nil
 	}
 
-	entry.MaxFingerprint = entry.FingerprintForSize(maxFingerprintSize)
+	attributesCopy := make(map[string]interface{}, len(attributes))
+	for k, v := range attributes {
+		attributesCopy[k] = copyAttributeValue(v)
+	}
 
-	return entry, nil
+	return attributesCopy
+}
+
+func copyAttributeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return copyAttributes(v)
+
+	case []interface{}:
+		valueCopy := make([]interface{}, len(v))
+		for i, element := range v {
+			valueCopy[i] = copyAttributeValue(element)
+		}
+		return valueCopy
+
+	default:
+		return value
+	}
+}
+
+// decodeJSONNumbers unmarshals JSON, decoding numbers in interface values as
+// json.Number rather than float64 so that none lose precision.
+func decodeJSONNumbers(b []byte, value interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// exactAttributeNumbers converts the json.Numbers in attributes decoded by
+// decodeJSONNumbers to float64, except for integers which a float64 can't hold
+// exactly. Those remain as json.Number.
+func exactAttributeNumbers(attributes map[string]interface{}) map[string]interface{} {
+	for k, v := range attributes {
+		attributes[k] = exactAttributeNumber(v)
+	}
+	return attributes
+}
+
+func exactAttributeNumber(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return exactAttributeNumbers(v)
+
+	case []interface{}:
+		for i, element := range v {
+			v[i] = exactAttributeNumber(element)
+		}
+		return v
+
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return v
+		}
+		if !strings.ContainsAny(string(v), ".eE") {
+			if i, err := v.Int64(); err != nil || int64(f) != i {
+				return v
+			}
+		}
+		return f
+
+	default:
+		return value
+	}
 }
 
 func makeThumbnail(src image.Image, size int) image.Image {
-	width := float64(src.Bounds().Max.X - src.Bounds().Min.X)
-	height := float64(src.Bounds().Max.Y - src.Bounds().Min.Y)
+	width := float64(src.Bounds().Dx())
+	height := float64(src.Bounds().Dy())
 	target := float64(size)
+	maxLength := target * maxThumbnailAspectRatio
 
 	if width > height {
-		width /= height / target
+		width = math.Min(width/(height/target), maxLength)
 		height = target
 	} else {
-		height /= width / target
+		height = math.Min(height/(width/target), maxLength)
 		width = target
 	}
 
@@ -103,7 +200,40 @@ func makeThumbnail(src image.Image, size int) image.Image {
 	return thumbnail
 }
 
+func newEntryKey() (string, error) {
+	keyBytes := make([]byte, keyBitLength/8)
+
+	_, err := rand.Read(keyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(keyBytes), nil
+}
+
+func newIndexEntry(image image.Image, maxFingerprintSize int, thumbnailSize int, algorithm FingerprintAlgorithm, attributes map[string]interface{}) (*IndexEntry, error) {
+	if image == nil {
+		return nil, ErrInvalidImage
+	}
+	if image.Bounds().Empty() {
+		return nil, &ImageError{Bounds: image.Bounds(), Err: ErrEmptyBounds}
+	}
+	if maxFingerprintSize < 1 {
+		return nil, ErrInvalidFingerprintSize
+	}
+
+	entry := &IndexEntry{
+		Thumbnail:  makeThumbnail(image, thumbnailSize),
+		Attributes: copyAttributes(attributes),
+	}
+
+	entry.MaxFingerprint = entry.fingerprintWith(algorithm, maxFingerprintSize)
+
+	return entry, nil
+}
+
 type indexEntryJSON struct {
+	Key            string                 `json:"key"`
 	MaxFingerprint []byte                 `json:"maxFingerprint"`
 	Attributes     map[string]interface{} `json:"attributes"`
 }
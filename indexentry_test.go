@@ -2,6 +2,9 @@ package simian
 
 import (
 	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
 	"reflect"
 	"testing"
 )
@@ -13,6 +16,7 @@ func TestIndexEntry(t *testing.T) {
 		t.Run("should roundtrip all fields", func(t *testing.T) {
 
 			entry := &IndexEntry{
+				Key:            "some-key",
 				MaxFingerprint: Fingerprint{samples: []uint8{0xF0, 0xF0, 0xF0, 0xF0}},
 				Attributes:     make(map[string]interface{}),
 			}
@@ -30,6 +34,9 @@ func TestIndexEntry(t *testing.T) {
 				t.Fatalf("Error unmarshalling JSON: %v", err)
 			}
 
+			if result.Key != entry.Key {
+				t.Errorf("Expected key '%s' but got '%s'", entry.Key, result.Key)
+			}
 			if distance := result.MaxFingerprint.Distance(entry.MaxFingerprint); distance != 0 {
 				t.Errorf("Expected no difference in fingerprints but got %d", distance)
 			}
@@ -38,4 +45,87 @@ func TestIndexEntry(t *testing.T) {
 			}
 		})
 	})
+	t.Run("NewIndexEntry()", func(t *testing.T) {
+
+		solidImage := func(width, height int) image.Image {
+			img := image.NewNRGBA(image.Rect(0, 0, width, height))
+			for i := img.Bounds().Min.Y; i < img.Bounds().Max.Y; i++ {
+				for j := img.Bounds().Min.X; j < img.Bounds().Max.X; j++ {
+					img.Set(j, i, color.RGBA{200, 100, 50, 255})
+				}
+			}
+			return img
+		}
+
+		t.Run("should reject an image with empty bounds", func(t *testing.T) {
+			for _, bounds := range []image.Rectangle{image.Rect(0, 0, 0, 0), image.Rect(0, 0, 10, 0), image.Rect(0, 0, 0, 10)} {
+				_, err := NewIndexEntry(image.NewNRGBA(bounds), 4, nil)
+
+				var imageErr *ImageError
+				if !errors.As(err, &imageErr) {
+					t.Fatalf("Expected ImageError for bounds %v but got %v", bounds, err)
+				}
+				if !errors.Is(err, ErrEmptyBounds) {
+					t.Errorf("Expected ErrEmptyBounds for bounds %v but got %v", bounds, err)
+				}
+				if imageErr.Bounds != bounds {
+					t.Errorf("Expected bounds %v but got %v", bounds, imageErr.Bounds)
+				}
+			}
+		})
+
+		t.Run("should reject a fingerprint size less than one", func(t *testing.T) {
+			_, err := NewIndexEntry(solidImage(10, 10), 0, nil)
+			if err != ErrInvalidFingerprintSize {
+				t.Errorf("Expected ErrInvalidFingerprintSize but got %v", err)
+			}
+		})
+
+		t.Run("should fingerprint a single pixel image", func(t *testing.T) {
+			entry, err := NewIndexEntry(solidImage(1, 1), 4, nil)
+			if err != nil {
+				t.Fatalf("Error creating entry: %v", err)
+			}
+
+			if actual, expected := entry.Thumbnail.Bounds(), image.Rect(0, 0, 8, 8); actual != expected {
+				t.Errorf("Expected thumbnail bounds %v but got %v", expected, actual)
+			}
+			if actual, expected := entry.MaxFingerprint.Size(), 4; actual != expected {
+				t.Errorf("Expected fingerprint size %d but got %d", expected, actual)
+			}
+		})
+
+		t.Run("should limit the thumbnail aspect ratio of extremely skewed images", func(t *testing.T) {
+			for _, size := range []image.Point{{X: 1, Y: 10000}, {X: 10000, Y: 1}} {
+				entry, err := NewIndexEntry(solidImage(size.X, size.Y), 4, nil)
+				if err != nil {
+					t.Fatalf("Error creating entry: %v", err)
+				}
+
+				bounds := entry.Thumbnail.Bounds()
+				shortest, longest := bounds.Dx(), bounds.Dy()
+				if shortest > longest {
+					shortest, longest = longest, shortest
+				}
+
+				if shortest != 8 {
+					t.Errorf("Expected shortest thumbnail side of 8 but got %d", shortest)
+				}
+				if longest != 8*maxThumbnailAspectRatio {
+					t.Errorf("Expected longest thumbnail side of %d but got %d", 8*maxThumbnailAspectRatio, longest)
+				}
+			}
+		})
+
+		t.Run("should use the given thumbnail size for the shortest side", func(t *testing.T) {
+			entry, err := newIndexEntry(solidImage(100, 50), 4, 20, LuminanceFingerprintAlgorithm{}, nil)
+			if err != nil {
+				t.Fatalf("Error creating entry: %v", err)
+			}
+
+			if actual, expected := entry.Thumbnail.Bounds(), image.Rect(0, 0, 40, 20); actual != expected {
+				t.Errorf("Expected thumbnail bounds %v but got %v", expected, actual)
+			}
+		})
+	})
 }
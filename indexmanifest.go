@@ -0,0 +1,96 @@
+package simian
+
+import (
+	"fmt"
+)
+
+// Format version 2 added bounds on the entries beneath each child node.
+const indexFormatVersion = 2
+
+// IndexManifest records the parameters an index was created with. Entries
+// fingerprinted with different parameters can't be compared, so an index
+// must always be reopened with the same ones.
+type IndexManifest struct {
+	FormatVersion           int     `json:"formatVersion"`
+	FingerprintAlgorithm    string  `json:"fingerprintAlgorithm"`
+	MaxFingerprintSize      int     `json:"maxFingerprintSize"`
+	MaxEntryDifference      float64 `json:"maxEntryDifference"`
+	ThumbnailSizeMultiplier int     `json:"thumbnailSizeMultiplier"`
+	MinThumbnailSize        int     `json:"minThumbnailSize"`
+}
+
+func (i *Index) applyDefaults() {
+	if i.maxFingerprintSize == 0 {
+		i.maxFingerprintSize = defaultMaxFingerprintSize
+	}
+	if i.maxEntryDifference == 0 {
+		i.maxEntryDifference = defaultMaxEntryDifference
+	}
+	if i.thumbnailSizeMultiplier == 0 {
+		i.thumbnailSizeMultiplier = defaultThumbnailSizeMultiplier
+	}
+	if i.fingerprintAlgorithm == nil {
+		i.fingerprintAlgorithm = LuminanceFingerprintAlgorithm{}
+	}
+}
+
+// applyManifest takes on any parameters which weren't specified from the
+// manifest, and checks that those which were specified match it.
+func (i *Index) applyManifest(m *IndexManifest) error {
+	if m.FormatVersion > indexFormatVersion {
+		return &kindError{kind: ErrUnsupportedFormat, err: fmt.Errorf("index format version %d is newer than supported version %d", m.FormatVersion, indexFormatVersion)}
+	} else if m.FormatVersion < indexFormatVersion {
+		return &kindError{kind: ErrUnsupportedFormat, err: fmt.Errorf("index format version %d must be migrated to version %d", m.FormatVersion, indexFormatVersion)}
+	}
+
+	if i.fingerprintAlgorithm == nil {
+		if m.FingerprintAlgorithm != (LuminanceFingerprintAlgorithm{}).Name() {
+			return incompatibleIndex("index uses fingerprint algorithm '%s', which must be specified", m.FingerprintAlgorithm)
+		}
+		i.fingerprintAlgorithm = LuminanceFingerprintAlgorithm{}
+
+	} else if name := i.fingerprintAlgorithm.Name(); name != m.FingerprintAlgorithm {
+		return incompatibleIndex("index was created with fingerprint algorithm '%s' but '%s' was requested", m.FingerprintAlgorithm, name)
+	}
+
+	if i.maxFingerprintSize == 0 {
+		i.maxFingerprintSize = m.MaxFingerprintSize
+	} else if i.maxFingerprintSize != m.MaxFingerprintSize {
+		return incompatibleIndex("index was created with max fingerprint size %d but %d was requested", m.MaxFingerprintSize, i.maxFingerprintSize)
+	}
+
+	if i.maxEntryDifference == 0 {
+		i.maxEntryDifference = m.MaxEntryDifference
+	} else if i.maxEntryDifference != m.MaxEntryDifference {
+		return incompatibleIndex("index was created with max entry difference %g but %g was requested", m.MaxEntryDifference, i.maxEntryDifference)
+	}
+
+	if i.thumbnailSizeMultiplier == 0 {
+		i.thumbnailSizeMultiplier = m.ThumbnailSizeMultiplier
+	} else if i.thumbnailSizeMultiplier != m.ThumbnailSizeMultiplier {
+		return incompatibleIndex("index was created with thumbnail size multiplier %d but %d was requested", m.ThumbnailSizeMultiplier, i.thumbnailSizeMultiplier)
+	}
+
+	if i.minThumbnailSize == 0 {
+		i.minThumbnailSize = m.MinThumbnailSize
+	} else if i.minThumbnailSize != m.MinThumbnailSize {
+		return incompatibleIndex("index was created with min thumbnail size %d but %d was requested", m.MinThumbnailSize, i.minThumbnailSize)
+	}
+
+	return nil
+}
+
+func (i *Index) manifest() *IndexManifest {
+	return &IndexManifest{
+		FormatVersion:           indexFormatVersion,
+		FingerprintAlgorithm:    i.fingerprintAlgorithm.Name(),
+		MaxFingerprintSize:      i.maxFingerprintSize,
+		MaxEntryDifference:      i.maxEntryDifference,
+		ThumbnailSizeMultiplier: i.thumbnailSizeMultiplier,
+		MinThumbnailSize:        i.minThumbnailSize,
+	}
+}
+
+func incompatibleIndex(format string, args ...interface{}) error {
+	return &kindError{kind: ErrIncompatibleIndex, err: fmt.Errorf(format, args...)}
+}
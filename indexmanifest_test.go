@@ -0,0 +1,144 @@
+package simian
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestIndexManifest(t *testing.T) {
+
+	create := func(t *testing.T, dir string) {
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		index.Close()
+	}
+
+	t.Run("should be written when an index is created", func(t *testing.T) {
+		dir := t.TempDir()
+
+		create(t, dir)
+
+		store, err := NewDiskIndexStore(dir)
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		defer store.Close()
+
+		manifest, err := store.GetManifest(context.Background())
+		if err != nil {
+			t.Fatalf("Error reading manifest: %v", err)
+		}
+
+		expected := IndexManifest{
+			FormatVersion:           indexFormatVersion,
+			FingerprintAlgorithm:    "luminance",
+			MaxFingerprintSize:      8,
+			MaxEntryDifference:      0.05,
+			ThumbnailSizeMultiplier: defaultThumbnailSizeMultiplier,
+		}
+		if manifest == nil || *manifest != expected {
+			t.Errorf("Expected manifest %+v but got %+v", expected, manifest)
+		}
+	})
+
+	t.Run("should supply stored parameters when reopening with zero values", func(t *testing.T) {
+		dir := t.TempDir()
+
+		create(t, dir)
+
+		index, err := NewIndex(dir, 0, 0)
+		if err != nil {
+			t.Fatalf("Error reopening index: %v", err)
+		}
+		defer index.Close()
+
+		if index.maxFingerprintSize != 8 {
+			t.Errorf("Expected max fingerprint size 8 but got %d", index.maxFingerprintSize)
+		}
+		if index.maxEntryDifference != 0.05 {
+			t.Errorf("Expected max entry difference 0.05 but got %f", index.maxEntryDifference)
+		}
+	})
+
+	t.Run("should reject mismatched parameters when reopening", func(t *testing.T) {
+		dir := t.TempDir()
+
+		create(t, dir)
+
+		_, err := NewIndex(dir, 12, 0.05)
+		if !errors.Is(err, ErrIncompatibleIndex) {
+			t.Fatalf("Expected ErrIncompatibleIndex but got %v", err)
+		}
+		if !strings.Contains(err.Error(), "max fingerprint size 8 but 12") {
+			t.Errorf("Expected error to describe the mismatch but got '%v'", err)
+		}
+
+		_, err = NewIndex(dir, 8, 0.2)
+		if !errors.Is(err, ErrIncompatibleIndex) {
+			t.Errorf("Expected ErrIncompatibleIndex but got %v", err)
+		}
+	})
+
+	t.Run("should reject a mismatched fingerprint algorithm", func(t *testing.T) {
+		dir := t.TempDir()
+
+		create(t, dir)
+
+		store, err := NewDiskIndexStore(dir)
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		defer store.Close()
+
+		_, err = NewIndexWithStore(store, WithFingerprintAlgorithm(invertedFingerprintAlgorithm{}))
+		if !errors.Is(err, ErrIncompatibleIndex) {
+			t.Errorf("Expected ErrIncompatibleIndex but got %v", err)
+		}
+	})
+
+	t.Run("should require a custom fingerprint algorithm to be specified", func(t *testing.T) {
+		store := NewMemoryIndexStore()
+
+		_, err := NewIndexWithStore(store, WithFingerprintAlgorithm(invertedFingerprintAlgorithm{}))
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+
+		_, err = NewIndexWithStore(store)
+		if !errors.Is(err, ErrIncompatibleIndex) {
+			t.Errorf("Expected ErrIncompatibleIndex but got %v", err)
+		}
+	})
+
+	t.Run("should reject a newer format version", func(t *testing.T) {
+		store := NewMemoryIndexStore()
+		store.PutManifest(context.Background(), &IndexManifest{FormatVersion: indexFormatVersion + 1, FingerprintAlgorithm: "luminance"})
+
+		_, err := NewIndexWithStore(store)
+		if !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Expected ErrUnsupportedFormat but got %v", err)
+		}
+	})
+
+	t.Run("should report a corrupt manifest", func(t *testing.T) {
+		dir := t.TempDir()
+
+		create(t, dir)
+
+		err := ioutil.WriteFile(path.Join(dir, manifestFileName), []byte("{"), 0600)
+		if err != nil {
+			t.Fatalf("Error writing manifest: %v", err)
+		}
+
+		_, err = NewIndex(dir, 8, 0.05)
+		if !errors.Is(err, ErrCorruptManifest) {
+			t.Errorf("Expected ErrCorruptManifest but got %v", err)
+		}
+	})
+}
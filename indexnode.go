@@ -1,71 +1,168 @@
 package simian
 
 import (
+	"container/heap"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"math"
-	"sort"
 )
 
-var errResultLimitReached = errors.New("result limit reached")
+var errMissingChild = errors.New("child node referenced by parent does not exist")
 
 type IndexNode struct {
 	childFingerprints         []Fingerprint
 	childFingerprintsByString map[string]*Fingerprint
+	childBounds               map[string]*fingerprintBounds
 	entries                   []*IndexEntry
+	parentCount               int
 }
 
-func (node *IndexNode) Add(entry *IndexEntry, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index) (*IndexNode, error) {
-
-	fmt.Printf("Node Add %d\n", childFingerprintSize)
+func (node *IndexNode) Add(ctx context.Context, entry *IndexEntry, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index) (*IndexNode, error) {
+	// Stop before changing anything. Once started, adding isn't stopped by the
+	// context, so that no child is left registered or bounds left widened
+	// without the entry beneath them, and no split is left half done.
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx = context.WithoutCancel(ctx)
 
-	childFingerprint := entry.FingerprintForSize(childFingerprintSize)
+	childFingerprint := index.fingerprintForSize(entry, childFingerprintSize)
 
 	if len(node.childFingerprints) == 0 {
 
 		// We can go deeper and this new entry is sufficiently different to
 		// the rest, so split this leaf node by turning entries into children.
-		fmt.Printf("Max Diff: %f\n", node.maxChildDifferenceTo(entry.MaxFingerprint))
 		if childFingerprintSize < index.maxFingerprintSize && node.maxChildDifferenceTo(entry.MaxFingerprint) > index.maxEntryDifference {
-			fmt.Printf("Pushing %d entries to children\n", len(node.entries))
-			node.pushEntriesToChildren(nodeFingerprint, childFingerprintSize, index.Store)
-			fmt.Printf("Done pushing entries to children\n")
+			index.log().Info("splitting node", "fingerprint", nodeFingerprint.String(), "depth", nodeDepth(childFingerprintSize), "entries", len(node.entries))
+			err := node.pushEntriesToChildren(ctx, nodeFingerprint, childFingerprintSize, index)
+			if err != nil {
+				return nil, err
+			}
 
 		} else {
-			fmt.Printf("Adding entry %s\n", nodeFingerprint.String())
-			err := index.Store.AddEntry(entry, node, nodeFingerprint)
+			index.log().Debug("adding entry to node", "key", entry.Key, "fingerprint", nodeFingerprint.String(), "depth", nodeDepth(childFingerprintSize), "entries", len(node.entries))
+			err := index.Store.AddEntry(ctx, entry, node, nodeFingerprint)
 			if err != nil {
 				return nil, err
 			}
-			fmt.Printf("Added entry\n")
 			return node, nil
 		}
 	}
 
-	child, err := index.Store.GetOrCreateChild(childFingerprint, node, nodeFingerprint)
+	child, err := index.Store.GetOrCreateChild(ctx, childFingerprint, node, nodeFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	err = index.Store.ExpandChildBounds(ctx, childFingerprint, entry.MaxFingerprint, node, nodeFingerprint)
 	if err != nil {
 		return nil, err
 	}
 
-	return child.Add(entry, childFingerprint, childFingerprintSize+1, index)
+	return child.Add(ctx, entry, childFingerprint, childFingerprintSize+1, index)
 }
 
-func (node *IndexNode) FindNearest(entry *IndexEntry, childFingerprintSize int, index *Index, maxResults int, maxDifference float64) ([]*IndexEntry, error) {
-	results := make([]*IndexEntry, 0, maxResults)
+// FindNearest searches the subtree rooted at this node for the entries
+// nearest to the given one. Nodes are searched in order of the smallest
+// difference any entry beneath them could have, so the search can stop as
+// soon as no unsearched node could hold a nearer entry than those found.
+//
+// A node can be the child of more than one parent, since nodes are identified
+// by fingerprint and entries with different fingerprints at one size can share
+// a fingerprint at the next. Each entry is within the bounds of every child
+// on the path it was added by, so following any path to a node is enough.
+func (node *IndexNode) FindNearest(ctx context.Context, entry *IndexEntry, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index, maxResults int, maxDifference float64, options *searchOptions) ([]SearchResult, error) {
+	results := &searchResultHeap{
+		results:       make([]SearchResult, 0, maxResults),
+		maxResults:    maxResults,
+		maxDifference: maxDifference,
+		options:       options,
+	}
 
-	err := node.gatherNearest(entry, childFingerprintSize, index, maxDifference, &results)
-	if err != nil && err != errResultLimitReached {
-		return nil, err
+	candidates := &nodeCandidateQueue{{node: node, fingerprint: nodeFingerprint, childFingerprintSize: childFingerprintSize}}
+	visited := make(map[string]bool)
+
+	for candidates.Len() > 0 {
+		candidate := heap.Pop(candidates).(nodeCandidate)
+
+		if !results.accepts(candidate.lowerBound) {
+			index.log().Debug("search complete", "results", results.Len(), "unsearched", candidates.Len()+1)
+			options.traceEnd(SearchBounded, nil)
+			return results.sorted(), nil
+		}
+
+		if visited[candidate.fingerprint.String()] {
+			continue
+		}
+
+		if !options.canVisit() {
+			index.log().Debug("search truncated", "results", results.Len(), "nodesVisited", options.stats.NodesVisited)
+			options.stats.Truncated = true
+			options.traceEnd(SearchNodeLimitReached, nil)
+			return results.sorted(), nil
+		}
+
+		visited[candidate.fingerprint.String()] = true
+		options.stats.NodesVisited++
+
+		current := candidate.node
+		if current == nil {
+			err := ctx.Err()
+			if err != nil {
+				return nil, err
+			}
+
+			current, err = index.Store.GetChild(ctx, candidate.fingerprint, candidate.parent)
+			if err != nil {
+				return nil, err
+			} else if current == nil {
+				return nil, corruptNode(candidate.fingerprint, errMissingChild)
+			}
+		}
+
+		index.log().Debug("visiting node", "depth", nodeDepth(candidate.childFingerprintSize), "children", len(current.childFingerprints), "entries", len(current.entries), "lowerBound", candidate.lowerBound)
+		options.traceNode(candidate.fingerprint, candidate.childFingerprintSize, current, candidate.lowerBound)
+
+		current.addSimilarEntriesTo(results, entry.MaxFingerprint, candidate.fingerprint, nodeDepth(candidate.childFingerprintSize), index.log())
+
+		for _, cf := range current.childFingerprints {
+			lowerBound := current.childLowerBound(cf, entry.MaxFingerprint)
+			if !results.accepts(lowerBound) {
+				options.tracePrune(cf, candidate.fingerprint, lowerBound)
+				continue
+			}
+
+			heap.Push(candidates, nodeCandidate{
+				parent:               current,
+				fingerprint:          cf,
+				childFingerprintSize: candidate.childFingerprintSize + 1,
+				lowerBound:           lowerBound,
+			})
+		}
 	}
 
-	return results, nil
+	options.traceEnd(SearchExhausted, nil)
+	return results.sorted(), nil
+}
+
+// FindWithin calls the given function with every entry in the subtree rooted
+// at this node which is within the max difference of the given one, until the
+// function returns false. Children whose bounds are too far away are skipped.
+func (node *IndexNode) FindWithin(ctx context.Context, entry *IndexEntry, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index, maxDifference float64, options *searchOptions, fn func(SearchResult) bool) error {
+	more, err := node.findWithin(ctx, entry, nodeFingerprint, childFingerprintSize, index, maxDifference, options, fn, make(map[string]bool))
+	if err == nil && more {
+		options.traceEnd(SearchExhausted, nil)
+	}
+	return err
 }
 
 func (node *IndexNode) MarshalJSON() ([]byte, error) {
 	return json.Marshal(&indexNodeJSON{
 		ChildFingerprints: node.childFingerprints,
+		ChildBounds:       node.childBounds,
 		Entries:           node.entries,
+		ParentCount:       node.parentCount,
 	})
 }
 
@@ -84,102 +181,226 @@ func (node *IndexNode) UnmarshalJSON(b []byte) error {
 		node.childFingerprintsByString[f.String()] = f
 	}
 
+	node.childBounds = value.ChildBounds
 	node.entries = value.Entries
+	node.parentCount = value.ParentCount
 
 	return nil
 }
 
-func (node *IndexNode) addSimilarEntriesTo(entries *[]*IndexEntry, fingerprint Fingerprint, maxDifference float64) error {
-	fmt.Printf("addSimilarEntriesTo\n")
+func (node *IndexNode) Remove(ctx context.Context, entry *IndexEntry, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index) (removed bool, err error) {
+	// As with adding, stop before changing anything, but once started, finish
+	// pruning the children left empty by removing the entry.
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	if existing := node.entryWithKey(entry.Key); existing != nil {
+		return true, index.Store.RemoveEntry(ctx, existing, node, nodeFingerprint)
+	}
+
+	childFingerprint := index.fingerprintForSize(entry, childFingerprintSize)
+	if _, ok := node.childFingerprintsByString[childFingerprint.String()]; !ok {
+		return false, nil
+	}
+
+	child, err := index.Store.GetChild(ctx, childFingerprint, node)
+	if err != nil {
+		return false, err
+	} else if child == nil {
+		return false, corruptNode(childFingerprint, errMissingChild)
+	}
 
-	return node.withEachEntry(func(entry *IndexEntry) error {
-		if len(*entries) >= cap(*entries) {
-			fmt.Printf("Max results hit\n")
-			return errResultLimitReached
+	removed, err = child.Remove(ctx, entry, childFingerprint, childFingerprintSize+1, index)
+	if err != nil || !removed {
+		return removed, err
+	}
+
+	// Prune the child if removing the entry left it with nothing in it
+	if child.isEmpty() {
+		err = index.Store.RemoveChild(ctx, childFingerprint, node, nodeFingerprint)
+		if err != nil {
+			return true, err
 		}
+	}
+
+	return true, nil
+}
+
+func (node *IndexNode) addSimilarEntriesTo(results *searchResultHeap, fingerprint Fingerprint, nodeFingerprint Fingerprint, depth int, logger Logger) {
+	node.withEachEntry(func(entry *IndexEntry) error {
+		options := results.options
+
+		if !options.includes(entry) {
+			logger.Debug("excluding entry", "key", entry.Key)
+			options.traceComparison(entry, nodeFingerprint, 0, EntryExcluded)
+			return nil
+		}
+
+		options.stats.EntriesCompared++
 
 		diff := entry.MaxFingerprint.Difference(fingerprint)
-		if diff <= maxDifference {
-			fmt.Printf("Found %d of difference %f\n", len(*entries), diff)
-			*entries = append(*entries, entry)
-		} else {
-			fmt.Printf("Max difference hit at %f\n", diff)
-			return errResultLimitReached
+		if !results.accepts(diff) {
+			logger.Debug("skipping entry", "key", entry.Key, "difference", diff)
+			options.traceComparison(entry, nodeFingerprint, diff, EntrySkipped)
+			return nil
 		}
 
+		logger.Debug("found entry", "key", entry.Key, "difference", diff)
+		options.traceComparison(entry, nodeFingerprint, diff, EntryFound)
+		results.add(SearchResult{
+			Entry:           entry,
+			Key:             entry.Key,
+			Difference:      diff,
+			Depth:           depth,
+			NodeFingerprint: nodeFingerprint,
+		})
+
 		return nil
 	})
 }
 
-func (node *IndexNode) gatherNearest(entry *IndexEntry, childFingerprintSize int, index *Index, maxDifference float64, results *[]*IndexEntry) error {
+// childLowerBound returns the smallest difference any entry beneath the given
+// child could have to the given fingerprint. Children without bounds could
+// hold anything.
+func (node *IndexNode) childLowerBound(childFingerprint Fingerprint, f Fingerprint) float64 {
+	bounds, ok := node.childBounds[childFingerprint.String()]
+	if !ok {
+		return 0
+	}
 
-	fmt.Printf("%d gatherNearest %d\n", childFingerprintSize, len(node.entries))
+	return bounds.lowerBound(f)
+}
 
-	// Check for an exact matching child
-	childFingerprint := entry.FingerprintForSize(childFingerprintSize)
-	exactChildFingerprint, exactChildFingerprintExists := node.childFingerprintsByString[childFingerprint.String()]
+// clone returns a copy of the node which can be changed without affecting
+// the original.
+func (node *IndexNode) clone() *IndexNode {
+	c := &IndexNode{
+		childFingerprints:         make([]Fingerprint, 0, len(node.childFingerprints)),
+		childFingerprintsByString: make(map[string]*Fingerprint, len(node.childFingerprints)),
+		entries:                   append([]*IndexEntry(nil), node.entries...),
+		parentCount:               node.parentCount,
+	}
 
-	var exactChildFingerprintString string
-	var exactChild *IndexNode
-	if exactChildFingerprintExists {
-		exactChildFingerprintString = exactChildFingerprint.String()
+	for _, f := range node.childFingerprints {
+		c.registerChild(f)
+	}
 
-		var err error
-		exactChild, err = index.Store.GetChild(childFingerprint, node)
-		if err != nil {
-			return err
+	if node.childBounds != nil {
+		c.childBounds = make(map[string]*fingerprintBounds, len(node.childBounds))
+		for k, b := range node.childBounds {
+			c.childBounds[k] = b.clone()
 		}
 	}
 
-	// One exists - recursively search it
-	if exactChild != nil {
-		err := exactChild.gatherNearest(entry, childFingerprintSize+1, index, maxDifference, results)
-		if err != nil {
-			return err
-		}
+	return c
+}
 
-		err = exactChild.addSimilarEntriesTo(results, entry.MaxFingerprint, maxDifference)
-		if err != nil {
-			return err
+func (node *IndexNode) entryWithKey(key string) *IndexEntry {
+	for _, entry := range node.entries {
+		if entry.Key == key {
+			return entry
 		}
 	}
 
-	childFingerprints := make([]Fingerprint, len(node.childFingerprints))
-	copy(childFingerprints, node.childFingerprints)
+	return nil
+}
+
+// expandChildBounds grows the bounds of the given child to contain the given
+// fingerprint, and reports whether they changed.
+func (node *IndexNode) expandChildBounds(childFingerprint Fingerprint, f Fingerprint) bool {
+	if node.childBounds == nil {
+		node.childBounds = make(map[string]*fingerprintBounds)
+	}
+
+	key := childFingerprint.String()
+
+	bounds, ok := node.childBounds[key]
+	if !ok {
+		node.childBounds[key] = newFingerprintBounds(f)
+		return true
+	}
+
+	return bounds.expand(f)
+}
 
-	// Need more results - find and sort all children by nearness
-	sort.Sort(nodesByDifferenceToFingerprintWith(childFingerprints, childFingerprint))
+func (node *IndexNode) findWithin(ctx context.Context, entry *IndexEntry, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index, maxDifference float64, options *searchOptions, fn func(SearchResult) bool, visited map[string]bool) (more bool, err error) {
+	visited[nodeFingerprint.String()] = true
+	options.stats.NodesVisited++
 
-	// fmt.Printf("Sorting %d children...\n", len(children))
-	// for i, child := range children {
-	// 	diff := child.fingerprint.Difference(entryFingerprint)
-	// 	fmt.Printf("%d sorted child %d of %f (%d %d)\n", childFingerprintSize+1, i, diff, len(child.fingerprint.samples), len(entryFingerprint.samples))
-	// }
+	index.log().Debug("visiting node", "depth", nodeDepth(childFingerprintSize), "children", len(node.childFingerprints), "entries", len(node.entries))
+	options.traceNode(nodeFingerprint, childFingerprintSize, node, 0)
 
-	// Recursively gather from nearest children
-	for i, cf := range childFingerprints {
-		fmt.Printf("Visiting child %d\n", i)
-		if exactChildFingerprintExists && cf.String() == exactChildFingerprintString {
+	for _, e := range node.entries {
+		if !options.includes(e) {
+			options.traceComparison(e, nodeFingerprint, 0, EntryExcluded)
 			continue
 		}
 
-		childNode, err := index.Store.GetChild(cf, node)
-		if err != nil {
-			return err
+		options.stats.EntriesCompared++
+
+		diff := e.MaxFingerprint.Difference(entry.MaxFingerprint)
+		if diff > maxDifference {
+			options.traceComparison(e, nodeFingerprint, diff, EntrySkipped)
+			continue
 		}
 
-		err = childNode.gatherNearest(entry, childFingerprintSize+1, index, maxDifference, results)
-		if err != nil {
-			return err
+		index.log().Debug("found entry", "key", e.Key, "difference", diff)
+		options.traceComparison(e, nodeFingerprint, diff, EntryFound)
+
+		more := fn(SearchResult{
+			Entry:           e.copy(),
+			Key:             e.Key,
+			Difference:      diff,
+			Depth:           nodeDepth(childFingerprintSize),
+			NodeFingerprint: nodeFingerprint,
+		})
+		if !more {
+			options.traceEnd(SearchStopped, nil)
+			return false, nil
+		}
+	}
+
+	for _, cf := range node.childFingerprints {
+		if visited[cf.String()] {
+			continue
+		}
+
+		if lowerBound := node.childLowerBound(cf, entry.MaxFingerprint); lowerBound > maxDifference {
+			options.tracePrune(cf, nodeFingerprint, lowerBound)
+			continue
+		}
+
+		if !options.canVisit() {
+			index.log().Debug("search truncated", "nodesVisited", options.stats.NodesVisited)
+			options.stats.Truncated = true
+			options.traceEnd(SearchNodeLimitReached, nil)
+			return false, nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return false, err
 		}
 
-		err = childNode.addSimilarEntriesTo(results, entry.MaxFingerprint, maxDifference)
+		child, err := index.Store.GetChild(ctx, cf, node)
 		if err != nil {
-			return err
+			return false, err
+		} else if child == nil {
+			return false, corruptNode(cf, errMissingChild)
+		}
+
+		more, err := child.findWithin(ctx, entry, cf, childFingerprintSize+1, index, maxDifference, options, fn, visited)
+		if err != nil || !more {
+			return false, err
 		}
 	}
 
-	return nil
+	return true, nil
+}
+
+func (node *IndexNode) isEmpty() bool {
+	return len(node.childFingerprints) == 0 && len(node.entries) == 0
 }
 
 func (node *IndexNode) maxChildDifferenceTo(f Fingerprint) float64 {
@@ -194,18 +415,25 @@ func (node *IndexNode) maxChildDifferenceTo(f Fingerprint) float64 {
 	return maxDifference
 }
 
-func (node *IndexNode) pushEntriesToChildren(nodeFingerprint Fingerprint, childFingerprintSize int, store IndexStore) error {
-	node.withEachEntry(func(entry *IndexEntry) error {
-		childFingerprint := entry.FingerprintForSize(childFingerprintSize)
-		child, err := store.GetOrCreateChild(childFingerprint, node, nodeFingerprint)
+func (node *IndexNode) pushEntriesToChildren(ctx context.Context, nodeFingerprint Fingerprint, childFingerprintSize int, index *Index) error {
+	err := node.withEachEntry(func(entry *IndexEntry) error {
+		childFingerprint := index.fingerprintForSize(entry, childFingerprintSize)
+		child, err := index.Store.GetOrCreateChild(ctx, childFingerprint, node, nodeFingerprint)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Pushing entry to child\n")
-		return store.AddEntry(entry, child, childFingerprint)
+		err = index.Store.ExpandChildBounds(ctx, childFingerprint, entry.MaxFingerprint, node, nodeFingerprint)
+		if err != nil {
+			return err
+		}
+		index.log().Debug("pushing entry to child", "key", entry.Key, "fingerprint", childFingerprint.String())
+		return index.Store.AddEntry(ctx, entry, child, childFingerprint)
 	})
+	if err != nil {
+		return err
+	}
 
-	return store.RemoveEntries(node, nodeFingerprint)
+	return index.Store.RemoveEntries(ctx, node, nodeFingerprint)
 }
 
 func (node *IndexNode) registerChild(childFingerprint Fingerprint) {
@@ -221,50 +449,63 @@ func (node *IndexNode) removeEntries() {
 	node.entries = nil
 }
 
-func (node *IndexNode) withEachEntry(action func(*IndexEntry) error) error {
-	for _, entry := range node.entries {
-		err := action(entry)
-		if err != nil {
-			return err
+func (node *IndexNode) removeEntry(key string) {
+	for i, entry := range node.entries {
+		if entry.Key == key {
+			node.entries = append(node.entries[:i], node.entries[i+1:]...)
+			return
 		}
 	}
-
-	return nil
 }
 
-type indexNodeJSON struct {
-	ChildFingerprints []Fingerprint `json:"childFingerprints"`
-	Entries           []*IndexEntry `json:"entries"`
+func (node *IndexNode) replaceEntry(entry *IndexEntry) {
+	for i, e := range node.entries {
+		if e.Key == entry.Key {
+			node.entries[i] = entry
+			return
+		}
+	}
 }
 
-type nodesByDifferenceToFingerprint struct {
-	nodeFingerprints []Fingerprint
-	differences      []float64
-}
+func (node *IndexNode) unregisterChild(childFingerprint Fingerprint) {
+	childFingerprintString := childFingerprint.String()
 
-func (sorter *nodesByDifferenceToFingerprint) Len() int {
-	return len(sorter.nodeFingerprints)
-}
+	remaining := make([]Fingerprint, 0, len(node.childFingerprints))
+	for _, f := range node.childFingerprints {
+		if f.String() != childFingerprintString {
+			remaining = append(remaining, f)
+		}
+	}
+	node.childFingerprints = remaining
+	delete(node.childBounds, childFingerprintString)
 
-func (sorter *nodesByDifferenceToFingerprint) Less(i, j int) bool {
-	return sorter.differences[i] < sorter.differences[j]
+	node.childFingerprintsByString = make(map[string]*Fingerprint)
+	for i := 0; i < len(node.childFingerprints); i++ {
+		f := &node.childFingerprints[i]
+		node.childFingerprintsByString[f.String()] = f
+	}
 }
 
-func (sorter *nodesByDifferenceToFingerprint) Swap(i, j int) {
-	tmp := sorter.nodeFingerprints[i]
-	sorter.nodeFingerprints[i] = sorter.nodeFingerprints[j]
-	sorter.nodeFingerprints[j] = tmp
+func (node *IndexNode) withEachEntry(action func(*IndexEntry) error) error {
+	for _, entry := range node.entries {
+		err := action(entry)
+		if err != nil {
+			return err
+		}
+	}
 
-	tmpDiff := sorter.differences[i]
-	sorter.differences[i] = sorter.differences[j]
-	sorter.differences[j] = tmpDiff
+	return nil
 }
 
-func nodesByDifferenceToFingerprintWith(nodeFingerprints []Fingerprint, f Fingerprint) *nodesByDifferenceToFingerprint {
-	differences := make([]float64, len(nodeFingerprints), len(nodeFingerprints))
-	for i, nf := range nodeFingerprints {
-		differences[i] = nf.Difference(f)
-	}
+// nodeDepth returns the depth in the tree of a node whose children have
+// fingerprints of the given size.
+func nodeDepth(childFingerprintSize int) int {
+	return childFingerprintSize - rootFingerprintSize - 1
+}
 
-	return &nodesByDifferenceToFingerprint{nodeFingerprints: nodeFingerprints, differences: differences}
+type indexNodeJSON struct {
+	ChildFingerprints []Fingerprint                 `json:"childFingerprints"`
+	ChildBounds       map[string]*fingerprintBounds `json:"childBounds,omitempty"`
+	Entries           []*IndexEntry                 `json:"entries"`
+	ParentCount       int                           `json:"parentCount,omitempty"`
 }
@@ -86,4 +86,37 @@ func TestIndexNode(t *testing.T) {
 			}
 		})
 	})
+	t.Run("unregisterChild()", func(t *testing.T) {
+
+		t.Run("should remove the child and keep lookups consistent", func(t *testing.T) {
+			n := &IndexNode{
+				childFingerprintsByString: make(map[string]*Fingerprint),
+			}
+
+			f1 := Fingerprint{samples: []uint8{0x10, 0x20, 0x30, 0x40}}
+			f2 := Fingerprint{samples: []uint8{0x50, 0x60, 0x70, 0x80}}
+			f3 := Fingerprint{samples: []uint8{0x90, 0xA0, 0xB0, 0xC0}}
+			n.registerChild(f1)
+			n.registerChild(f2)
+			n.registerChild(f3)
+
+			n.unregisterChild(f2)
+
+			if actual, expected := len(n.childFingerprints), 2; actual != expected {
+				t.Fatalf("Expected %d child fingerprints but got %d", expected, actual)
+			}
+			if _, ok := n.childFingerprintsByString[f2.String()]; ok {
+				t.Errorf("Expected fingerprint '%s' to be removed", f2.String())
+			}
+			for _, f := range []Fingerprint{f1, f3} {
+				mapped, ok := n.childFingerprintsByString[f.String()]
+				if !ok {
+					t.Fatalf("Expected fingerprint '%s' to remain", f.String())
+				}
+				if actual, expected := mapped.String(), f.String(); actual != expected {
+					t.Errorf("Expected fingerprint '%s' but got '%s'", expected, actual)
+				}
+			}
+		})
+	})
 }
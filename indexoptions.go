@@ -0,0 +1,92 @@
+package simian
+
+import (
+	"fmt"
+)
+
+const defaultMaxEntryDifference = 0.1
+const defaultMaxFingerprintSize = 8
+const defaultThumbnailSizeMultiplier = 2
+
+// IndexOption configures an Index created by NewIndexWithStore. Options which
+// are zero or nil are treated as unspecified, and take on the values the index
+// was created with, or default values for a new index.
+type IndexOption func(*Index)
+
+// WithFingerprintAlgorithm sets the algorithm used to fingerprint images.
+func WithFingerprintAlgorithm(algorithm FingerprintAlgorithm) IndexOption {
+	return func(i *Index) {
+		i.fingerprintAlgorithm = algorithm
+	}
+}
+
+// WithLogger sets the logger which receives events from the index and, where
+// supported, its store.
+func WithLogger(logger Logger) IndexOption {
+	return func(i *Index) {
+		i.logger = logger
+	}
+}
+
+// WithMaxEntryDifference sets the difference between entries beyond which a
+// node is split into children.
+func WithMaxEntryDifference(difference float64) IndexOption {
+	return func(i *Index) {
+		i.maxEntryDifference = difference
+	}
+}
+
+// WithMaxFingerprintSize sets the size of the fingerprints used to compare
+// entries, which also limits the depth of the tree.
+func WithMaxFingerprintSize(size int) IndexOption {
+	return func(i *Index) {
+		i.maxFingerprintSize = size
+	}
+}
+
+// WithMinThumbnailSize sets the minimum length of the shortest side of entry
+// thumbnails.
+func WithMinThumbnailSize(size int) IndexOption {
+	return func(i *Index) {
+		i.minThumbnailSize = size
+	}
+}
+
+// WithThumbnailSizeMultiplier sets the length of the shortest side of entry
+// thumbnails as a multiple of the max fingerprint size.
+func WithThumbnailSizeMultiplier(multiplier int) IndexOption {
+	return func(i *Index) {
+		i.thumbnailSizeMultiplier = multiplier
+	}
+}
+
+func (i *Index) validate() error {
+	if i.Store == nil {
+		return invalidOptions("a store is required")
+	}
+
+	return i.validateParameters()
+}
+
+// validateParameters checks the parameters which determine how entries are
+// fingerprinted and arranged.
+func (i *Index) validateParameters() error {
+	if i.maxFingerprintSize <= rootFingerprintSize {
+		return invalidOptions("max fingerprint size %d must be larger than the root fingerprint size %d", i.maxFingerprintSize, rootFingerprintSize)
+	}
+	if i.maxEntryDifference < 0 || i.maxEntryDifference > 1 {
+		return invalidOptions("max entry difference %f must be between 0 and 1", i.maxEntryDifference)
+	}
+	if i.thumbnailSizeMultiplier < 1 {
+		return invalidOptions("thumbnail size multiplier %d must be at least 1", i.thumbnailSizeMultiplier)
+	}
+	if i.minThumbnailSize < 0 {
+		return invalidOptions("min thumbnail size %d must not be negative", i.minThumbnailSize)
+	}
+
+	return nil
+}
+
+func invalidOptions(format string, args ...interface{}) error {
+	return &kindError{kind: ErrInvalidOptions, err: fmt.Errorf(format, args...)}
+}
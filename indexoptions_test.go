@@ -0,0 +1,156 @@
+package simian
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+type loggingMemoryIndexStore struct {
+	*MemoryIndexStore
+	logger Logger
+}
+
+func (s *loggingMemoryIndexStore) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+type invertedFingerprintAlgorithm struct{}
+
+func (invertedFingerprintAlgorithm) Name() string {
+	return "inverted"
+}
+
+func (invertedFingerprintAlgorithm) Fingerprint(src image.Image, size int) Fingerprint {
+	f := NewFingerprint(src, size)
+	for i := range f.samples {
+		f.samples[i] = ^f.samples[i] & (sampleBitsMask << (8 - bitsPerSample))
+	}
+	return f
+}
+
+func TestIndexOptions(t *testing.T) {
+
+	t.Run("NewIndexWithStore()", func(t *testing.T) {
+
+		t.Run("should apply defaults", func(t *testing.T) {
+			index, err := NewIndexWithStore(NewMemoryIndexStore())
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			if index.maxFingerprintSize != defaultMaxFingerprintSize {
+				t.Errorf("Expected max fingerprint size %d but got %d", defaultMaxFingerprintSize, index.maxFingerprintSize)
+			}
+			if index.maxEntryDifference != defaultMaxEntryDifference {
+				t.Errorf("Expected max entry difference %f but got %f", defaultMaxEntryDifference, index.maxEntryDifference)
+			}
+			if index.thumbnailSizeMultiplier != defaultThumbnailSizeMultiplier {
+				t.Errorf("Expected thumbnail size multiplier %d but got %d", defaultThumbnailSizeMultiplier, index.thumbnailSizeMultiplier)
+			}
+			if _, ok := index.fingerprintAlgorithm.(LuminanceFingerprintAlgorithm); !ok {
+				t.Errorf("Expected luminance fingerprint algorithm but got %T", index.fingerprintAlgorithm)
+			}
+		})
+
+		t.Run("should reject invalid options", func(t *testing.T) {
+			cases := []struct {
+				name    string
+				store   IndexStore
+				options []IndexOption
+			}{
+				{"no store", nil, nil},
+				{"max fingerprint size not larger than root", NewMemoryIndexStore(), []IndexOption{WithMaxFingerprintSize(rootFingerprintSize)}},
+				{"negative max entry difference", NewMemoryIndexStore(), []IndexOption{WithMaxEntryDifference(-0.1)}},
+				{"max entry difference above one", NewMemoryIndexStore(), []IndexOption{WithMaxEntryDifference(1.5)}},
+				{"negative thumbnail size multiplier", NewMemoryIndexStore(), []IndexOption{WithThumbnailSizeMultiplier(-1)}},
+				{"negative min thumbnail size", NewMemoryIndexStore(), []IndexOption{WithMinThumbnailSize(-1)}},
+			}
+
+			for _, c := range cases {
+				_, err := NewIndexWithStore(c.store, c.options...)
+				if !errors.Is(err, ErrInvalidOptions) {
+					t.Errorf("Expected ErrInvalidOptions for %s but got %v", c.name, err)
+				}
+			}
+		})
+
+		t.Run("should size thumbnails using the multiplier and minimum", func(t *testing.T) {
+			index, err := NewIndexWithStore(NewMemoryIndexStore(), WithMaxFingerprintSize(4), WithThumbnailSizeMultiplier(3))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			entry, err := index.newEntry(testImageWithSeed(1), nil)
+			if err != nil {
+				t.Fatalf("Error creating entry: %v", err)
+			}
+			if actual, expected := entry.Thumbnail.Bounds(), image.Rect(0, 0, 12, 12); actual != expected {
+				t.Errorf("Expected thumbnail bounds %v but got %v", expected, actual)
+			}
+
+			index, err = NewIndexWithStore(NewMemoryIndexStore(), WithMaxFingerprintSize(4), WithMinThumbnailSize(20))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			entry, err = index.newEntry(testImageWithSeed(1), nil)
+			if err != nil {
+				t.Fatalf("Error creating entry: %v", err)
+			}
+			if actual, expected := entry.Thumbnail.Bounds(), image.Rect(0, 0, 20, 20); actual != expected {
+				t.Errorf("Expected thumbnail bounds %v but got %v", expected, actual)
+			}
+		})
+
+		t.Run("should fingerprint entries with the given algorithm", func(t *testing.T) {
+			index, err := NewIndexWithStore(NewMemoryIndexStore(), WithFingerprintAlgorithm(invertedFingerprintAlgorithm{}))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			var key string
+			for i := 20; i >= 1; i-- {
+				key, err = index.Add(testImageWithSeed(i), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			entry, err := index.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+
+			expected := invertedFingerprintAlgorithm{}.Fingerprint(entry.Thumbnail, defaultMaxFingerprintSize)
+			if distance := entry.MaxFingerprint.Distance(expected); distance != 0 {
+				t.Errorf("Expected fingerprint from custom algorithm but got distance %d", distance)
+			}
+
+			results, err := index.FindNearest(testImageWithSeed(1), 1, 0.0)
+			if err != nil {
+				t.Fatalf("Error finding nearest: %v", err)
+			}
+			if len(results) != 1 || results[0].Key != key {
+				t.Errorf("Expected to find the entry but got %v", results)
+			}
+		})
+
+		t.Run("should pass the logger on to the store", func(t *testing.T) {
+			store := &loggingMemoryIndexStore{MemoryIndexStore: NewMemoryIndexStore()}
+			logger := &recordingLogger{}
+
+			index, err := NewIndexWithStore(store, WithLogger(logger))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			if index.logger != logger {
+				t.Errorf("Expected logger to be set on the index")
+			}
+			if store.logger != logger {
+				t.Errorf("Expected logger to be set on the store")
+			}
+		})
+	})
+}
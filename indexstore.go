@@ -1,10 +1,24 @@
 package simian
 
+import (
+	"context"
+)
+
+// IndexStore holds the nodes and entries of an index. Stores should give up
+// and return the context's error once a context is done.
 type IndexStore interface {
-	AddEntry(entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error
+	AddEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error
 	Close() error
-	GetChild(f Fingerprint, parent *IndexNode) (*IndexNode, error)
-	GetOrCreateChild(f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error)
-	GetRoot() (*IndexNode, error)
-	RemoveEntries(node *IndexNode, nodeFingerprint Fingerprint) error
+	ExpandChildBounds(ctx context.Context, f Fingerprint, entryFingerprint Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error
+	GetChild(ctx context.Context, f Fingerprint, parent *IndexNode) (*IndexNode, error)
+	GetEntry(ctx context.Context, key string) (*IndexEntry, error)
+	GetManifest(ctx context.Context) (*IndexManifest, error)
+	GetOrCreateChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error)
+	GetRoot(ctx context.Context) (*IndexNode, error)
+	PutBatch(ctx context.Context, batch *NodeBatch) error
+	PutManifest(ctx context.Context, manifest *IndexManifest) error
+	RemoveChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error
+	RemoveEntries(ctx context.Context, node *IndexNode, nodeFingerprint Fingerprint) error
+	RemoveEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error
+	UpdateEntry(ctx context.Context, key string, update func(entry *IndexEntry)) error
 }
@@ -0,0 +1,378 @@
+package simian
+
+import (
+	"context"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const defaultIngestBatchSize = 100
+
+// IngestSource is an image to be added by Ingest. Open is called by a worker
+// once it's ready to decode the image, so that sources waiting their turn
+// don't hold files open. Images are decoded with image.Decode, so the formats
+// to be ingested must be registered, such as by importing image/jpeg.
+type IngestSource struct {
+	Name       string
+	Attributes map[string]interface{}
+	Open       func() (io.ReadCloser, error)
+}
+
+// IngestResult is the outcome of ingesting a source: the key it was added
+// with, or the error which stopped it being added.
+type IngestResult struct {
+	Name string
+	Key  string
+	Err  error
+}
+
+// IngestProgress counts the sources ingested so far.
+type IngestProgress struct {
+	Added  int
+	Failed int
+}
+
+// IngestOption configures an ingestion.
+type IngestOption func(*ingestOptions)
+
+type ingestOptions struct {
+	workers    int
+	batchSize  int
+	onProgress func(IngestProgress)
+	onResult   func(IngestResult)
+}
+
+// preparedSource is a source which has been decoded and fingerprinted, ready
+// to be added.
+type preparedSource struct {
+	name  string
+	entry *IndexEntry
+	err   error
+}
+
+// FileIngestSource returns a source which reads the image in the given file,
+// named by its path.
+func FileIngestSource(path string) IngestSource {
+	return IngestSource{
+		Name: path,
+		Open: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}
+}
+
+// Ingest adds the images from the given sources until the channel is closed.
+// Sources are decoded and fingerprinted by a pool of workers, and added by a
+// single writer in batches, as by AddBatch. Workers only take sources as fast
+// as the writer can add them, so a producer sending on the channel is held
+// back rather than buffering images in memory.
+//
+// A source which can't be opened or decoded is reported as failed and the
+// rest carry on. A source without an Open function fails with
+// ErrInvalidIngestSource. An error from the store stops the ingestion, as does
+// the context being done, and is returned along with the progress so far. The
+// entries in a batch which couldn't be written are reported as failed, while
+// sources still being decoded when ingestion stopped aren't reported. Sources
+// sent after ingestion stops are discarded in the background, so that the
+// producer isn't left blocked, until the channel is closed.
+func (i *Index) Ingest(ctx context.Context, sources <-chan IngestSource, options ...IngestOption) (IngestProgress, error) {
+	o := newIngestOptions(options)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Runs before the deferred cancel, so only when ingestion stopped early
+	defer func() {
+		if ctx.Err() != nil {
+			go discardSources(sources)
+		}
+	}()
+
+	prepared := make(chan preparedSource, o.batchSize)
+
+	var workers sync.WaitGroup
+	for w := 0; w < o.workers; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			i.prepareSources(ctx, sources, prepared)
+		}()
+	}
+
+	go func() {
+		workers.Wait()
+		close(prepared)
+	}()
+
+	var progress IngestProgress
+	var batch []preparedSource
+
+	report := func(result IngestResult) {
+		if result.Err != nil {
+			progress.Failed++
+		} else {
+			progress.Added++
+		}
+		o.onResult(result)
+	}
+
+	flush := func() error {
+		entries := make([]*IndexEntry, len(batch))
+		for n, p := range batch {
+			entries[n] = p.entry
+		}
+
+		err := i.addBatch(ctx, entries)
+		for _, p := range batch {
+			if err != nil {
+				report(IngestResult{Name: p.name, Err: err})
+			} else {
+				report(IngestResult{Name: p.name, Key: p.entry.Key})
+			}
+		}
+
+		batch = batch[:0]
+		o.onProgress(progress)
+
+		return err
+	}
+
+	for p := range prepared {
+		if p.err != nil {
+			report(IngestResult{Name: p.name, Err: p.err})
+			continue
+		}
+
+		batch = append(batch, p)
+		if len(batch) < o.batchSize {
+			continue
+		}
+
+		err := flush()
+		if err != nil {
+			i.log().Error("ingestion stopped", "error", err)
+			cancel()
+
+			// Let the workers finish with what they've taken
+			for range prepared {
+				continue
+			}
+
+			return progress, err
+		}
+	}
+
+	if len(batch) > 0 {
+		err := flush()
+		if err != nil {
+			return progress, err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return progress, err
+	}
+
+	o.onProgress(progress)
+
+	return progress, nil
+}
+
+// IngestDirectory adds the images in the given directory and the directories
+// beneath it, as by Ingest. Hidden files and directories are skipped, and
+// other files which aren't images are reported as failed, as are files and
+// directories beneath it which can't be read.
+func (i *Index) IngestDirectory(ctx context.Context, dir string, options ...IngestOption) (IngestProgress, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sources := make(chan IngestSource)
+	walkErr := make(chan error, 1)
+
+	go func() {
+		defer close(sources)
+
+		send := func(source IngestSource) error {
+			select {
+			case sources <- source:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		walkErr <- filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+
+				// Only the directory itself not being readable stops the walk
+				if path == dir {
+					return err
+				}
+
+				sendErr := send(failedIngestSource(path, err))
+				if sendErr == nil && d != nil && d.IsDir() {
+					return filepath.SkipDir
+				}
+				return sendErr
+			}
+
+			hidden := path != dir && strings.HasPrefix(d.Name(), ".")
+
+			if d.IsDir() {
+				if hidden {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if hidden || !d.Type().IsRegular() {
+				return nil
+			}
+
+			return send(FileIngestSource(path))
+		})
+	}()
+
+	progress, err := i.Ingest(ctx, sources, options...)
+
+	// Stop the walk if ingestion stopped first
+	cancel()
+
+	if walkErr := <-walkErr; err == nil && walkErr != nil {
+		err = walkErr
+	}
+
+	return progress, err
+}
+
+// prepareSources decodes and fingerprints sources until there are no more or
+// the context is done.
+func (i *Index) prepareSources(ctx context.Context, sources <-chan IngestSource, prepared chan<- preparedSource) {
+	for {
+		var source IngestSource
+		var ok bool
+
+		select {
+		case source, ok = <-sources:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		p := preparedSource{name: source.Name}
+		p.entry, p.err = i.prepareSource(source)
+
+		select {
+		case prepared <- p:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (i *Index) prepareSource(source IngestSource) (*IndexEntry, error) {
+	if source.Open == nil {
+		return nil, ErrInvalidIngestSource
+	}
+
+	reader, err := source.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := i.newEntry(img, source.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Key, err = newEntryKey()
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// ReportingProgress calls the given function with the progress so far after
+// each batch is written, and once more when ingestion is done. It's called
+// from the goroutine which called Ingest.
+func ReportingProgress(fn func(IngestProgress)) IngestOption {
+	return func(o *ingestOptions) {
+		o.onProgress = fn
+	}
+}
+
+// ReportingResults calls the given function with the outcome of each source.
+// It's called from the goroutine which called Ingest, one result at a time.
+func ReportingResults(fn func(IngestResult)) IngestOption {
+	return func(o *ingestOptions) {
+		o.onResult = fn
+	}
+}
+
+// UsingWorkers sets the number of sources decoded and fingerprinted at once.
+// It defaults to the number of CPUs which can be used at once.
+func UsingWorkers(workers int) IngestOption {
+	return func(o *ingestOptions) {
+		o.workers = workers
+	}
+}
+
+// WritingBatchesOf sets the number of entries the writer adds at once, which
+// is also the number of decoded entries which can wait for it.
+func WritingBatchesOf(size int) IngestOption {
+	return func(o *ingestOptions) {
+		o.batchSize = size
+	}
+}
+
+// discardSources receives sources until the channel is closed.
+func discardSources(sources <-chan IngestSource) {
+	for range sources {
+	}
+}
+
+// failedIngestSource returns a source which fails to open with the given
+// error, so that it's reported like any other failure.
+func failedIngestSource(name string, err error) IngestSource {
+	return IngestSource{
+		Name: name,
+		Open: func() (io.ReadCloser, error) {
+			return nil, err
+		},
+	}
+}
+
+func newIngestOptions(options []IngestOption) *ingestOptions {
+	o := &ingestOptions{}
+	for _, option := range options {
+		option(o)
+	}
+
+	if o.workers < 1 {
+		o.workers = runtime.GOMAXPROCS(0)
+	}
+	if o.batchSize < 1 {
+		o.batchSize = defaultIngestBatchSize
+	}
+	if o.onProgress == nil {
+		o.onProgress = func(IngestProgress) {}
+	}
+	if o.onResult == nil {
+		o.onResult = func(IngestResult) {}
+	}
+
+	return o
+}
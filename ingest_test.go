@@ -0,0 +1,360 @@
+package simian
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIngest(t *testing.T) {
+
+	pngBytes := func(t *testing.T, random *rand.Rand) []byte {
+		var buffer bytes.Buffer
+		err := png.Encode(&buffer, randomTestImage(random))
+		if err != nil {
+			t.Fatalf("Error encoding image: %v", err)
+		}
+		return buffer.Bytes()
+	}
+
+	bytesSource := func(name string, b []byte) IngestSource {
+		return IngestSource{
+			Name:       name,
+			Attributes: map[string]interface{}{"name": name},
+			Open: func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			},
+		}
+	}
+
+	sendAll := func(sources []IngestSource) <-chan IngestSource {
+		c := make(chan IngestSource)
+		go func() {
+			defer close(c)
+			for _, s := range sources {
+				c <- s
+			}
+		}()
+		return c
+	}
+
+	t.Run("Ingest()", func(t *testing.T) {
+
+		t.Run("should add decodable sources and report the rest as failed", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			random := rand.New(rand.NewSource(1))
+			openErr := errors.New("can't open")
+
+			var sources []IngestSource
+			for i := 0; i < 30; i++ {
+				sources = append(sources, bytesSource(string(rune('a'+i)), pngBytes(t, random)))
+			}
+			sources = append(sources, bytesSource("not an image", []byte("hello")))
+			sources = append(sources, IngestSource{Name: "unopenable", Open: func() (io.ReadCloser, error) { return nil, openErr }})
+			sources = append(sources, IngestSource{Name: "without open"})
+
+			results := make(map[string]IngestResult)
+			var progressReports []IngestProgress
+
+			progress, err := index.Ingest(context.Background(), sendAll(sources),
+				UsingWorkers(4),
+				WritingBatchesOf(8),
+				ReportingResults(func(r IngestResult) { results[r.Name] = r }),
+				ReportingProgress(func(p IngestProgress) { progressReports = append(progressReports, p) }))
+			if err != nil {
+				t.Fatalf("Error ingesting: %v", err)
+			}
+
+			if progress.Added != 30 || progress.Failed != 3 {
+				t.Errorf("Expected 30 added and 3 failed but got %+v", progress)
+			}
+			if len(progressReports) == 0 || progressReports[len(progressReports)-1] != progress {
+				t.Errorf("Expected final progress to be reported but got %v", progressReports)
+			}
+
+			if results["not an image"].Err == nil {
+				t.Errorf("Expected undecodable source to fail")
+			}
+			if results["unopenable"].Err != openErr {
+				t.Errorf("Expected '%v' but got '%v'", openErr, results["unopenable"].Err)
+			}
+			if results["without open"].Err != ErrInvalidIngestSource {
+				t.Errorf("Expected ErrInvalidIngestSource but got '%v'", results["without open"].Err)
+			}
+
+			for _, s := range sources[:30] {
+				result := results[s.Name]
+				if result.Err != nil {
+					t.Fatalf("Expected '%s' to be added but got %v", s.Name, result.Err)
+				}
+
+				entry, err := index.Get(result.Key)
+				if err != nil {
+					t.Fatalf("Error getting entry: %v", err)
+				}
+				if entry == nil || entry.Attributes["name"] != s.Name {
+					t.Errorf("Expected entry for '%s' but got %v", s.Name, entry)
+				}
+			}
+		})
+
+		t.Run("should hold back sources while the writer is busy", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			release := make(chan struct{})
+			index.Store = &blockingIndexStore{IndexStore: index.Store, release: release}
+
+			const workers = 2
+			const batchSize = 2
+
+			random := rand.New(rand.NewSource(1))
+			image := pngBytes(t, random)
+
+			var taken int32
+			sources := make(chan IngestSource)
+			go func() {
+				defer close(sources)
+				for i := 0; i < 50; i++ {
+					sources <- bytesSource("image", image)
+					atomic.AddInt32(&taken, 1)
+				}
+			}()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err = index.Ingest(context.Background(), sources, UsingWorkers(workers), WritingBatchesOf(batchSize))
+			}()
+
+			time.Sleep(200 * time.Millisecond)
+
+			// One batch being written, one batch waiting, and one source
+			// held by each worker
+			if n := atomic.LoadInt32(&taken); n > batchSize*2+workers {
+				t.Errorf("Expected at most %d sources to be taken but got %d", batchSize*2+workers, n)
+			}
+
+			close(release)
+			wg.Wait()
+
+			if err != nil {
+				t.Fatalf("Error ingesting: %v", err)
+			}
+			if n := atomic.LoadInt32(&taken); n != 50 {
+				t.Errorf("Expected all sources to be taken but got %d", n)
+			}
+		})
+
+		t.Run("should stop at a store failure", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			storeErr := errors.New("disk full")
+			index.Store = &failingBatchIndexStore{IndexStore: index.Store, err: storeErr}
+
+			random := rand.New(rand.NewSource(1))
+			image := pngBytes(t, random)
+
+			// Send more sources than can be taken before the first batch fails
+			sent := make(chan struct{})
+			sources := make(chan IngestSource)
+			go func() {
+				defer close(sent)
+				defer close(sources)
+				for i := 0; i < 100; i++ {
+					sources <- bytesSource("image", image)
+				}
+			}()
+
+			var failed int
+			progress, err := index.Ingest(context.Background(), sources, WritingBatchesOf(5), ReportingResults(func(r IngestResult) {
+				if r.Err == storeErr {
+					failed++
+				}
+			}))
+			if err != storeErr {
+				t.Fatalf("Expected '%v' but got %v", storeErr, err)
+			}
+			if failed != 5 || progress.Failed != 5 || progress.Added != 0 {
+				t.Errorf("Expected the first batch to fail but got %d failures and %+v", failed, progress)
+			}
+
+			select {
+			case <-sent:
+			case <-time.After(time.Second):
+				t.Errorf("Expected the producer to be able to send the rest of its sources")
+			}
+		})
+
+		t.Run("should stop once the context is done", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			sources := make(chan IngestSource)
+			defer close(sources)
+
+			_, err = index.Ingest(ctx, sources)
+			if err != context.Canceled {
+				t.Errorf("Expected context.Canceled but got %v", err)
+			}
+		})
+	})
+
+	t.Run("IngestDirectory()", func(t *testing.T) {
+
+		t.Run("should add the images beneath the directory and skip hidden files", func(t *testing.T) {
+			dir := t.TempDir()
+
+			random := rand.New(rand.NewSource(1))
+			files := map[string][]byte{
+				"a.png":           pngBytes(t, random),
+				"sub/b.png":       pngBytes(t, random),
+				"sub/c.png":       pngBytes(t, random),
+				"notes.txt":       []byte("not an image"),
+				".hidden.png":     pngBytes(t, random),
+				".hidden/d.png":   pngBytes(t, random),
+				"sub/.hidden.txt": []byte("not an image"),
+			}
+			for name, b := range files {
+				filePath := path.Join(dir, name)
+				err := os.MkdirAll(path.Dir(filePath), 0700)
+				if err != nil {
+					t.Fatalf("Error creating directory: %v", err)
+				}
+				err = ioutil.WriteFile(filePath, b, 0600)
+				if err != nil {
+					t.Fatalf("Error writing file: %v", err)
+				}
+			}
+
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			var failures []string
+			progress, err := index.IngestDirectory(context.Background(), dir, ReportingResults(func(r IngestResult) {
+				if r.Err != nil {
+					failures = append(failures, r.Name)
+				}
+			}))
+			if err != nil {
+				t.Fatalf("Error ingesting: %v", err)
+			}
+
+			if progress.Added != 3 || progress.Failed != 1 {
+				t.Errorf("Expected 3 added and 1 failed but got %+v", progress)
+			}
+			if len(failures) != 1 || failures[0] != path.Join(dir, "notes.txt") {
+				t.Errorf("Expected only notes.txt to fail but got %v", failures)
+			}
+		})
+
+		t.Run("should report unreadable directories as failed and carry on", func(t *testing.T) {
+			if os.Geteuid() == 0 {
+				t.Skip("Permissions aren't enforced for root")
+			}
+
+			dir := t.TempDir()
+
+			random := rand.New(rand.NewSource(1))
+			for _, name := range []string{"a.png", "locked/b.png"} {
+				filePath := path.Join(dir, name)
+				err := os.MkdirAll(path.Dir(filePath), 0700)
+				if err != nil {
+					t.Fatalf("Error creating directory: %v", err)
+				}
+				err = ioutil.WriteFile(filePath, pngBytes(t, random), 0600)
+				if err != nil {
+					t.Fatalf("Error writing file: %v", err)
+				}
+			}
+
+			lockedDir := path.Join(dir, "locked")
+			err := os.Chmod(lockedDir, 0)
+			if err != nil {
+				t.Fatalf("Error changing permissions: %v", err)
+			}
+			defer os.Chmod(lockedDir, 0700)
+
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			var failures []string
+			progress, err := index.IngestDirectory(context.Background(), dir, ReportingResults(func(r IngestResult) {
+				if r.Err != nil {
+					failures = append(failures, r.Name)
+				}
+			}))
+			if err != nil {
+				t.Fatalf("Error ingesting: %v", err)
+			}
+
+			if progress.Added != 1 || progress.Failed != 1 {
+				t.Errorf("Expected 1 added and 1 failed but got %+v", progress)
+			}
+			if len(failures) != 1 || failures[0] != lockedDir {
+				t.Errorf("Expected only the locked directory to fail but got %v", failures)
+			}
+		})
+
+		t.Run("should fail for a missing directory", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			_, err = index.IngestDirectory(context.Background(), "/nonexistent/simian-ingest-test")
+			if !os.IsNotExist(err) {
+				t.Errorf("Expected a not exist error but got %v", err)
+			}
+		})
+	})
+}
+
+// blockingIndexStore holds up writing batches until it's released.
+type blockingIndexStore struct {
+	IndexStore
+	release chan struct{}
+}
+
+func (s *blockingIndexStore) PutBatch(ctx context.Context, batch *NodeBatch) error {
+	<-s.release
+	return s.IndexStore.PutBatch(ctx, batch)
+}
+
+type failingBatchIndexStore struct {
+	IndexStore
+	err error
+}
+
+func (s *failingBatchIndexStore) PutBatch(ctx context.Context, batch *NodeBatch) error {
+	return s.err
+}
@@ -0,0 +1,128 @@
+package simian
+
+import (
+	"image"
+	"sync"
+)
+
+// LinearIndex finds entries by comparing every one of them, so its results
+// are always exact. It is far too slow for real use, but serves as a
+// reference against which Index can be checked. It fingerprints images in
+// the same way as an Index created with the same options.
+type LinearIndex struct {
+	params  *Index
+	entries []*IndexEntry
+	mutex   sync.RWMutex
+}
+
+func (l *LinearIndex) Add(image image.Image, metadata map[string]interface{}) (key string, err error) {
+	entry, err := l.params.newEntry(image, metadata)
+	if err != nil {
+		return "", err
+	}
+
+	entry.Key, err = newEntryKey()
+	if err != nil {
+		return "", err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.entries = append(l.entries, entry)
+
+	return entry.Key, nil
+}
+
+// FindNearest returns the entries within the max difference of the given
+// image, nearest first.
+func (l *LinearIndex) FindNearest(image image.Image, maxResults int, maxDifference float64, options ...SearchOption) ([]*IndexEntry, error) {
+	return resultEntries(l.Search(image, maxResults, maxDifference, options...))
+}
+
+// FindWithin calls the given function with every entry within the max
+// difference of the given image until the function returns false.
+func (l *LinearIndex) FindWithin(image image.Image, maxDifference float64, fn func(SearchResult) bool, options ...SearchOption) error {
+	var dummy map[string]interface{}
+
+	entry, err := l.params.newEntry(image, dummy)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	o := newSearchOptions(options)
+
+	for _, e := range l.entries {
+		if !o.includes(e) {
+			continue
+		}
+
+		diff := e.MaxFingerprint.Difference(entry.MaxFingerprint)
+		if diff <= maxDifference && !fn(SearchResult{Entry: e.copy(), Key: e.Key, Difference: diff}) {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (l *LinearIndex) Get(key string) (*IndexEntry, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	for _, entry := range l.entries {
+		if entry.Key == key {
+			return entry.copy(), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Search returns the entries most similar to the given image, nearest first,
+// along with how different each one is. Results are always at depth zero.
+func (l *LinearIndex) Search(image image.Image, maxResults int, maxDifference float64, options ...SearchOption) ([]SearchResult, error) {
+	var dummy map[string]interface{}
+
+	entry, err := l.params.newEntry(image, dummy)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	results := &searchResultHeap{
+		results:       make([]SearchResult, 0, maxResults),
+		maxResults:    maxResults,
+		maxDifference: maxDifference,
+		options:       newSearchOptions(options),
+	}
+
+	node := &IndexNode{entries: l.entries}
+	node.addSimilarEntriesTo(results, entry.MaxFingerprint, Fingerprint{}, 0, l.params.log())
+
+	return results.sorted(), nil
+}
+
+// NewLinearIndex creates an empty LinearIndex. Options which aren't specified
+// take on the same default values as for an Index.
+func NewLinearIndex(options ...IndexOption) (*LinearIndex, error) {
+	l := &LinearIndex{params: &Index{}}
+
+	for _, option := range options {
+		option(l.params)
+	}
+
+	l.params.applyDefaults()
+
+	err := l.params.validateParameters()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
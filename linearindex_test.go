@@ -0,0 +1,205 @@
+package simian
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+func TestLinearIndex(t *testing.T) {
+
+	t.Run("Get()", func(t *testing.T) {
+
+		t.Run("should not share stored entries with callers", func(t *testing.T) {
+			l, err := NewLinearIndex(WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			key, err := l.Add(testImageWithSeed(1), map[string]interface{}{"seed": 1.0})
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+
+			entry, err := l.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			entry.Attributes["seed"] = 2.0
+
+			err = l.FindWithin(testImageWithSeed(1), 0.0, func(result SearchResult) bool {
+				result.Entry.Attributes["seed"] = 3.0
+				return true
+			})
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+
+			entry, err = l.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if actual, expected := entry.Attributes["seed"], 1.0; actual != expected {
+				t.Errorf("Expected attribute %v but got %v", expected, actual)
+			}
+		})
+	})
+
+	t.Run("Search()", func(t *testing.T) {
+
+		t.Run("should return every entry within the max difference, nearest first", func(t *testing.T) {
+			l, err := NewLinearIndex(WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			for i := 1; i <= 20; i++ {
+				_, err := l.Add(testImageWithSeed(i), nil)
+				if err != nil {
+					t.Fatalf("Error adding entry: %v", err)
+				}
+			}
+
+			results, err := l.Search(testImageWithSeed(5), 100, 1.0)
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if len(results) != 20 {
+				t.Fatalf("Expected 20 results but got %d", len(results))
+			}
+			if results[0].Difference != 0 {
+				t.Errorf("Expected an exact match first but got difference %v", results[0].Difference)
+			}
+			for j := 1; j < len(results); j++ {
+				if results[j-1].Difference > results[j].Difference {
+					t.Errorf("Expected results to be sorted by difference but %v came before %v", results[j-1].Difference, results[j].Difference)
+				}
+			}
+		})
+	})
+
+	t.Run("recall of Index", func(t *testing.T) {
+
+		options := []IndexOption{WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05)}
+
+		index, err := NewIndexWithStore(NewMemoryIndexStore(), options...)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+
+		linear, err := NewLinearIndex(options...)
+		if err != nil {
+			t.Fatalf("Error creating linear index: %v", err)
+		}
+
+		random := rand.New(rand.NewSource(1))
+
+		var corpus []image.Image
+		for i := 0; i < 100; i++ {
+			img := randomTestImage(random)
+			corpus = append(corpus, img, perturbedTestImage(random, img), perturbedTestImage(random, img))
+		}
+
+		for _, img := range corpus {
+			if _, err := index.Add(img, nil); err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+			if _, err := linear.Add(img, nil); err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+		}
+
+		var queries []image.Image
+		for i := 0; i < 50; i++ {
+			queries = append(queries, perturbedTestImage(random, corpus[random.Intn(len(corpus))]), randomTestImage(random))
+		}
+
+		for _, k := range []int{1, 5, 10} {
+			for _, maxDifference := range []float64{0.1, 1.0} {
+				recall := measureRecall(t, index, linear, queries, k, maxDifference)
+				t.Logf("recall@%d within %v: %.3f", k, maxDifference, recall)
+
+				if recall != 1.0 {
+					t.Errorf("Expected recall@%d within %v of 1 but got %v", k, maxDifference, recall)
+				}
+			}
+		}
+	})
+}
+
+// measureRecall returns the fraction of the k nearest entries found by the
+// linear index which the tree index also finds. Entries tied with the kth
+// nearest are interchangeable, so any of them counts.
+func measureRecall(t *testing.T, index *Index, linear *LinearIndex, queries []image.Image, k int, maxDifference float64) float64 {
+	expected := 0
+	found := 0
+
+	for _, query := range queries {
+		want, err := linear.Search(query, k, maxDifference)
+		if err != nil {
+			t.Fatalf("Error searching linear index: %v", err)
+		}
+		if len(want) == 0 {
+			continue
+		}
+
+		got, err := index.Search(query, k, maxDifference)
+		if err != nil {
+			t.Fatalf("Error searching index: %v", err)
+		}
+
+		furthest := want[len(want)-1].Difference
+
+		expected += len(want)
+		for _, result := range got {
+			if result.Difference <= furthest {
+				found++
+			}
+		}
+	}
+
+	if expected == 0 {
+		return 1.0
+	}
+
+	return float64(found) / float64(expected)
+}
+
+func perturbedTestImage(random *rand.Rand, src image.Image) image.Image {
+	img := image.NewNRGBA(src.Bounds())
+
+	for i := img.Bounds().Min.Y; i < img.Bounds().Max.Y; i++ {
+		for j := img.Bounds().Min.X; j < img.Bounds().Max.X; j++ {
+			r, _, _, _ := src.At(j, i).RGBA()
+			v := int(r>>8) + random.Intn(41) - 20
+			if v < 0 {
+				v = 0
+			} else if v > 255 {
+				v = 255
+			}
+			img.Set(j, i, color.RGBA{uint8(v), uint8(v), uint8(v), 255})
+		}
+	}
+
+	return img
+}
+
+func randomTestImage(random *rand.Rand) image.Image {
+	img := image.NewNRGBA(image.Rectangle{Max: image.Point{X: 32, Y: 32}})
+
+	// Blocks of random grey, so that images differ at every fingerprint size
+	blocks := make([]uint8, 16)
+	for i := range blocks {
+		blocks[i] = uint8(random.Intn(256))
+	}
+
+	for i := img.Bounds().Min.Y; i < img.Bounds().Max.Y; i++ {
+		for j := img.Bounds().Min.X; j < img.Bounds().Max.X; j++ {
+			v := blocks[(i/8)*4+j/8]
+			img.Set(j, i, color.RGBA{v, v, v, 255})
+		}
+	}
+
+	return img
+}
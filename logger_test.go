@@ -0,0 +1,72 @@
+package simian
+
+import (
+	"io/ioutil"
+	"log/slog"
+	"testing"
+)
+
+var _ Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+
+type recordingLogger struct {
+	events []loggedEvent
+}
+
+type loggedEvent struct {
+	level string
+	msg   string
+	args  []interface{}
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.record("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.record("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record("error", msg, args) }
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.events = append(l.events, loggedEvent{level: level, msg: msg, args: args})
+}
+
+func (l *recordingLogger) find(level, msg string) *loggedEvent {
+	for i := range l.events {
+		if l.events[i].level == level && l.events[i].msg == msg {
+			return &l.events[i]
+		}
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+
+	t.Run("should receive events from the index and its store", func(t *testing.T) {
+		dir := t.TempDir()
+
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		defer index.Close()
+
+		logger := &recordingLogger{}
+		index.SetLogger(logger)
+
+		for i := 1; i <= 20; i++ {
+			_, err := index.Add(testImageWithSeed(i), nil)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+		}
+
+		split := logger.find("info", "splitting node")
+		if split == nil {
+			t.Fatalf("Expected a node split to be logged")
+		}
+		if len(split.args)%2 != 0 {
+			t.Errorf("Expected key/value pairs but got %v", split.args)
+		}
+
+		if logger.find("debug", "saving node") == nil {
+			t.Errorf("Expected store events to be logged")
+		}
+	})
+}
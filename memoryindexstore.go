@@ -0,0 +1,354 @@
+package simian
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryIndexStore is an IndexStore which keeps all nodes, entries and
+// thumbnails in memory. It can be saved to and loaded from the directory
+// format used by DiskIndexStore. Its operations never wait, so it ignores
+// contexts.
+type MemoryIndexStore struct {
+	mutex            sync.RWMutex
+	nodes            map[string]*IndexNode
+	nodeFingerprints map[string]Fingerprint
+	entryLocations   map[string]Fingerprint
+	manifest         *IndexManifest
+}
+
+func (s *MemoryIndexStore) AddEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node.registerEntry(entry)
+	s.putNode(nodeFingerprint, node)
+	s.entryLocations[entry.Key] = nodeFingerprint
+
+	return nil
+}
+
+func (s *MemoryIndexStore) Close() error {
+	return nil
+}
+
+func (s *MemoryIndexStore) ExpandChildBounds(ctx context.Context, f Fingerprint, entryFingerprint Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if parent.expandChildBounds(f, entryFingerprint) {
+		s.putNode(parentFingerprint, parent)
+	}
+
+	return nil
+}
+
+func (s *MemoryIndexStore) GetChild(ctx context.Context, f Fingerprint, parent *IndexNode) (*IndexNode, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.nodes[f.String()], nil
+}
+
+func (s *MemoryIndexStore) GetEntry(ctx context.Context, key string) (*IndexEntry, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entry := s.entryWithKey(key)
+	if entry == nil {
+		return nil, nil
+	}
+
+	// Return a copy so that callers can't modify the stored entry
+	return entry.copy(), nil
+}
+
+func (s *MemoryIndexStore) GetManifest(ctx context.Context) (*IndexManifest, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.manifest == nil {
+		return nil, nil
+	}
+
+	manifestCopy := *s.manifest
+	return &manifestCopy, nil
+}
+
+func (s *MemoryIndexStore) GetOrCreateChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) (*IndexNode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node, exists := s.nodes[f.String()]
+	if _, registered := parent.childFingerprintsByString[f.String()]; exists && registered {
+		return node, nil
+	}
+
+	if !exists {
+		node = &IndexNode{
+			childFingerprintsByString: make(map[string]*Fingerprint),
+		}
+		s.putNode(f, node)
+	}
+	node.parentCount++
+
+	parent.registerChild(f)
+	s.putNode(parentFingerprint, parent)
+
+	return node, nil
+}
+
+func (s *MemoryIndexStore) GetRoot(ctx context.Context) (*IndexNode, error) {
+	var rootFingerprint Fingerprint
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	root, exists := s.nodes[rootFingerprint.String()]
+	if !exists {
+		root = &IndexNode{
+			childFingerprintsByString: make(map[string]*Fingerprint),
+		}
+	}
+
+	return root, nil
+}
+
+func (s *MemoryIndexStore) PutBatch(ctx context.Context, batch *NodeBatch) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, n := range batch.Nodes {
+		s.putNode(n.Fingerprint, n.Node)
+	}
+
+	for key, nodeFingerprint := range batch.EntryLocations {
+		s.entryLocations[key] = nodeFingerprint
+	}
+
+	return nil
+}
+
+func (s *MemoryIndexStore) PutManifest(ctx context.Context, manifest *IndexManifest) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	manifestCopy := *manifest
+	s.manifest = &manifestCopy
+
+	return nil
+}
+
+func (s *MemoryIndexStore) RemoveChild(ctx context.Context, f Fingerprint, parent *IndexNode, parentFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	parent.unregisterChild(f)
+	s.putNode(parentFingerprint, parent)
+
+	// Keep the child while other parents still refer to it
+	if child, exists := s.nodes[f.String()]; exists {
+		child.parentCount--
+		if child.parentCount > 0 {
+			return nil
+		}
+	}
+
+	delete(s.nodes, f.String())
+	delete(s.nodeFingerprints, f.String())
+
+	return nil
+}
+
+func (s *MemoryIndexStore) RemoveEntries(ctx context.Context, node *IndexNode, nodeFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node.removeEntries()
+	s.putNode(nodeFingerprint, node)
+
+	return nil
+}
+
+func (s *MemoryIndexStore) RemoveEntry(ctx context.Context, entry *IndexEntry, node *IndexNode, nodeFingerprint Fingerprint) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	node.removeEntry(entry.Key)
+	s.putNode(nodeFingerprint, node)
+	delete(s.entryLocations, entry.Key)
+
+	return nil
+}
+
+// SaveToDisk writes the contents of the store to a directory in the format
+// used by DiskIndexStore. The directory must not already contain an index.
+func (s *MemoryIndexStore) SaveToDisk(rootPath string) error {
+	disk, err := NewDiskIndexStore(rootPath)
+	if err != nil {
+		return err
+	}
+
+	var rootFingerprint Fingerprint
+
+	existingRoot, err := disk.readNode(rootFingerprint)
+	if err != nil {
+		disk.Close()
+		return err
+	} else if existingRoot != nil {
+		disk.Close()
+		return ErrIndexExists
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// A store which no index has used yet has the default parameters
+	manifest := s.manifest
+	if manifest == nil {
+		var defaults Index
+		defaults.applyDefaults()
+		manifest = defaults.manifest()
+	}
+
+	err = disk.PutManifest(context.Background(), manifest)
+	if err != nil {
+		disk.Close()
+		return err
+	}
+
+	for fingerprintString, node := range s.nodes {
+		nodeFingerprint := s.nodeFingerprints[fingerprintString]
+
+		err = node.withEachEntry(func(entry *IndexEntry) error {
+			err := entry.saveThumbnail(disk.pathForThumbnail(entry))
+			if err != nil {
+				return storeFailureForNode(nodeFingerprint, err)
+			}
+
+			return disk.putEntryLocation(entry.Key, nodeFingerprint)
+		})
+		if err != nil {
+			disk.Close()
+			return err
+		}
+
+		err = disk.putNode(nodeFingerprint, node)
+		if err != nil {
+			disk.Close()
+			return err
+		}
+	}
+
+	return disk.Close()
+}
+
+func (s *MemoryIndexStore) UpdateEntry(ctx context.Context, key string, update func(entry *IndexEntry)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry := s.entryWithKey(key)
+	if entry == nil {
+		return ErrEntryNotFound
+	}
+
+	node := s.nodes[s.entryLocations[key].String()]
+
+	// Update a copy, so that an entry is never changed once other goroutines
+	// can see it
+	updated := entry.copy()
+	update(updated)
+	node.replaceEntry(updated)
+
+	return nil
+}
+
+func (s *MemoryIndexStore) entryWithKey(key string) *IndexEntry {
+	nodeFingerprint, exists := s.entryLocations[key]
+	if !exists {
+		return nil
+	}
+
+	node, exists := s.nodes[nodeFingerprint.String()]
+	if !exists {
+		return nil
+	}
+
+	return node.entryWithKey(key)
+}
+
+func (s *MemoryIndexStore) loadFromDisk(disk *DiskIndexStore, f Fingerprint, node *IndexNode) error {
+	// A child shared by more than one parent only needs loading once
+	if _, loaded := s.nodes[f.String()]; loaded {
+		return nil
+	}
+
+	s.putNode(f, node)
+
+	node.withEachEntry(func(entry *IndexEntry) error {
+		s.entryLocations[entry.Key] = f
+		return nil
+	})
+
+	for _, cf := range node.childFingerprints {
+		child, err := disk.GetChild(context.Background(), cf, node)
+		if err != nil {
+			return err
+		} else if child == nil {
+			return corruptNode(cf, errMissingChild)
+		}
+
+		err = s.loadFromDisk(disk, cf, child)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryIndexStore) putNode(f Fingerprint, node *IndexNode) {
+	s.nodes[f.String()] = node
+	s.nodeFingerprints[f.String()] = f
+}
+
+func NewMemoryIndexStore() *MemoryIndexStore {
+	return &MemoryIndexStore{
+		nodes:            make(map[string]*IndexNode),
+		nodeFingerprints: make(map[string]Fingerprint),
+		entryLocations:   make(map[string]Fingerprint),
+	}
+}
+
+// NewMemoryIndexStoreFromDisk loads the entire contents of a DiskIndexStore
+// directory into memory. The directory is only locked while it is read.
+func NewMemoryIndexStoreFromDisk(rootPath string) (*MemoryIndexStore, error) {
+	disk, err := NewDiskIndexStoreWithLockMode(rootPath, LockShared)
+	if err != nil {
+		return nil, err
+	}
+	defer disk.Close()
+
+	var rootFingerprint Fingerprint
+
+	root, err := disk.getNode(rootFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewMemoryIndexStore()
+
+	s.manifest, err = disk.GetManifest(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	if root != nil {
+		err = s.loadFromDisk(disk, rootFingerprint, root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
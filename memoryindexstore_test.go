@@ -0,0 +1,227 @@
+package simian
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryIndexStore(t *testing.T) {
+
+	populate := func(t *testing.T, index *Index, count int) []string {
+		var keys []string
+
+		for i := 1; i <= count; i++ {
+			key, err := index.Add(testImageWithSeed(i), map[string]interface{}{"seed": float64(i)})
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+			keys = append(keys, key)
+		}
+
+		return keys
+	}
+
+	expectEntries := func(t *testing.T, index *Index, keys []string) {
+		for i, key := range keys {
+			entry, err := index.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if entry == nil {
+				t.Fatalf("Expected entry for key '%s' but got none", key)
+			}
+			if actual, expected := entry.Attributes["seed"], float64(i+1); actual != expected {
+				t.Errorf("Expected attribute %v but got %v", expected, actual)
+			}
+			if entry.Thumbnail == nil {
+				t.Errorf("Expected thumbnail for key '%s'", key)
+			}
+
+			results, err := index.FindNearest(testImageWithSeed(i+1), 1, 0.0)
+			if err != nil {
+				t.Fatalf("Error finding nearest: %v", err)
+			}
+			if len(results) != 1 {
+				t.Errorf("Expected to find entry for key '%s' but got %d results", key, len(results))
+			}
+		}
+	}
+
+	t.Run("should support adding, finding, updating and removing entries", func(t *testing.T) {
+		index, err := NewMemoryIndex(8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		keys := populate(t, index, 20)
+
+		expectEntries(t, index, keys)
+
+		err = index.UpdateAttributes(keys[0], map[string]interface{}{"seed": 100.0})
+		if err != nil {
+			t.Fatalf("Error updating attributes: %v", err)
+		}
+		entry, err := index.Get(keys[0])
+		if err != nil {
+			t.Fatalf("Error getting entry: %v", err)
+		}
+		if actual, expected := entry.Attributes["seed"], 100.0; actual != expected {
+			t.Errorf("Expected attribute %v but got %v", expected, actual)
+		}
+
+		for _, key := range keys {
+			err := index.Remove(key)
+			if err != nil {
+				t.Fatalf("Error removing entry: %v", err)
+			}
+		}
+
+		root, err := index.Store.GetRoot(context.Background())
+		if err != nil {
+			t.Fatalf("Error getting root: %v", err)
+		}
+		if !root.isEmpty() {
+			t.Errorf("Expected empty root but got %d children and %d entries", len(root.childFingerprints), len(root.entries))
+		}
+	})
+
+	t.Run("should not share stored entries with callers", func(t *testing.T) {
+		index, err := NewMemoryIndex(8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+
+		key, err := index.Add(testImageWithSeed(1), map[string]interface{}{"seed": 1.0, "tags": []interface{}{"a"}})
+		if err != nil {
+			t.Fatalf("Error adding entry: %v", err)
+		}
+
+		entry, err := index.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting entry: %v", err)
+		}
+		entry.Attributes["seed"] = 2.0
+		entry.Attributes["tags"].([]interface{})[0] = "b"
+
+		results, err := index.Search(testImageWithSeed(1), 1, 0.0)
+		if err != nil {
+			t.Fatalf("Error searching: %v", err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Expected 1 result but got %d", len(results))
+		}
+		results[0].Entry.Attributes["seed"] = 3.0
+
+		err = index.UpdateAttributes(key, map[string]interface{}{"seed": 4.0})
+		if err != nil {
+			t.Fatalf("Error updating attributes: %v", err)
+		}
+		if actual, expected := results[0].Entry.Attributes["seed"], 3.0; actual != expected {
+			t.Errorf("Expected earlier result to keep attribute %v but got %v", expected, actual)
+		}
+
+		entry, err = index.Get(key)
+		if err != nil {
+			t.Fatalf("Error getting entry: %v", err)
+		}
+		if actual, expected := entry.Attributes["seed"], 4.0; actual != expected {
+			t.Errorf("Expected attribute %v but got %v", expected, actual)
+		}
+		if actual, expected := entry.Attributes["tags"].([]interface{})[0], "a"; actual != expected {
+			t.Errorf("Expected tag %v but got %v", expected, actual)
+		}
+	})
+
+	t.Run("SaveToDisk()", func(t *testing.T) {
+
+		t.Run("should write an index which can be opened from disk", func(t *testing.T) {
+			dir := t.TempDir()
+
+			memoryIndex, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+			keys := populate(t, memoryIndex, 20)
+
+			err = memoryIndex.Store.(*MemoryIndexStore).SaveToDisk(dir)
+			if err != nil {
+				t.Fatalf("Error saving to disk: %v", err)
+			}
+
+			diskIndex, err := NewIndex(dir, 8, 0.05)
+			if err != nil {
+				t.Fatalf("Error opening index: %v", err)
+			}
+			defer diskIndex.Close()
+
+			expectEntries(t, diskIndex, keys)
+		})
+
+		t.Run("should write a manifest for a store which no index has used", func(t *testing.T) {
+			dir := t.TempDir()
+
+			err := NewMemoryIndexStore().SaveToDisk(dir)
+			if err != nil {
+				t.Fatalf("Error saving to disk: %v", err)
+			}
+
+			store, err := NewDiskIndexStore(dir)
+			if err != nil {
+				t.Fatalf("Error opening store: %v", err)
+			}
+			defer store.Close()
+
+			manifest, err := store.GetManifest(context.Background())
+			if err != nil {
+				t.Fatalf("Error getting manifest: %v", err)
+			}
+			if manifest == nil {
+				t.Fatalf("Expected a manifest but got none")
+			}
+			if actual, expected := manifest.FormatVersion, indexFormatVersion; actual != expected {
+				t.Errorf("Expected format version %d but got %d", expected, actual)
+			}
+		})
+
+		t.Run("should refuse to overwrite an existing index", func(t *testing.T) {
+			dir := t.TempDir()
+
+			diskIndex, err := NewIndex(dir, 8, 0.05)
+			if err != nil {
+				t.Fatalf("Error opening index: %v", err)
+			}
+			populate(t, diskIndex, 1)
+			diskIndex.Close()
+
+			err = NewMemoryIndexStore().SaveToDisk(dir)
+			if err != ErrIndexExists {
+				t.Errorf("Expected ErrIndexExists but got %v", err)
+			}
+		})
+	})
+
+	t.Run("NewMemoryIndexStoreFromDisk()", func(t *testing.T) {
+
+		t.Run("should load an index from disk", func(t *testing.T) {
+			dir := t.TempDir()
+
+			diskIndex, err := NewIndex(dir, 8, 0.05)
+			if err != nil {
+				t.Fatalf("Error opening index: %v", err)
+			}
+			keys := populate(t, diskIndex, 20)
+			diskIndex.Close()
+
+			store, err := NewMemoryIndexStoreFromDisk(dir)
+			if err != nil {
+				t.Fatalf("Error loading from disk: %v", err)
+			}
+
+			memoryIndex, err := NewIndexWithStore(store, WithMaxFingerprintSize(8), WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			expectEntries(t, memoryIndex, keys)
+		})
+	})
+}
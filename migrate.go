@@ -0,0 +1,431 @@
+package simian
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// MigrationReport describes the changes made (or which would be made, for a
+// dry run) by Migrate.
+type MigrationReport struct {
+	FromVersion        int
+	ToVersion          int
+	NodesVisited       int
+	EntriesKeyed       int
+	ThumbnailsCopied   int
+	ThumbnailsRemoved  int
+	ChildBoundsSet     int
+	ManifestWritten    bool
+	MaxFingerprintSize int
+}
+
+// Migrate upgrades the index in the given directory to the current format in
+// place. Each step can safely be repeated, so an interrupted migration can be
+// resumed by running it again. With dryRun, nothing is written or created and
+// the report describes what would have been changed.
+//
+// Indexes from before format version 1 don't record the max entry difference
+// they were created with, so it must be given as an option.
+func Migrate(rootPath string, dryRun bool, options ...IndexOption) (*MigrationReport, error) {
+	lockMode := LockExclusive
+	if dryRun {
+		lockMode = LockShared
+	}
+
+	store, err := NewDiskIndexStoreWithLockMode(rootPath, lockMode)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	index := &Index{Store: store}
+	for _, option := range options {
+		option(index)
+	}
+
+	manifest, err := store.GetManifest(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{FromVersion: 0, ToVersion: indexFormatVersion}
+	m := &migration{store: store, index: index, dryRun: dryRun, report: report}
+
+	if manifest != nil {
+		report.FromVersion = manifest.FormatVersion
+		report.MaxFingerprintSize = manifest.MaxFingerprintSize
+
+		if manifest.FormatVersion > indexFormatVersion {
+			return nil, &kindError{kind: ErrUnsupportedFormat, err: fmt.Errorf("index format version %d is newer than supported version %d", manifest.FormatVersion, indexFormatVersion)}
+		} else if manifest.FormatVersion == indexFormatVersion {
+			return report, nil
+		}
+
+		// Keep the parameters the index was created with
+		manifest.FormatVersion = indexFormatVersion
+		err = index.applyManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		err = m.checkVersion0Options()
+		if err != nil {
+			return nil, err
+		}
+
+		err = m.fromVersion0()
+		if err != nil {
+			return nil, err
+		}
+
+		// An empty index has nothing to migrate, and gets a manifest when opened
+		if report.NodesVisited == 0 {
+			report.FromVersion = report.ToVersion
+			return report, nil
+		}
+	}
+
+	err = m.fromVersion1()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.writeManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+type migration struct {
+	store  *DiskIndexStore
+	index  *Index
+	dryRun bool
+	report *MigrationReport
+}
+
+// fromVersion0 assigns keys to entries, copies their thumbnails from paths
+// based on their fingerprints to paths based on their keys, and removes the
+// old thumbnails once every entry has been copied.
+func (m *migration) fromVersion0() error {
+	var rootFingerprint Fingerprint
+
+	var nodeFingerprints []Fingerprint
+	err := m.walk(rootFingerprint, func(f Fingerprint, node *IndexNode) error {
+		nodeFingerprints = append(nodeFingerprints, f)
+		return m.keyEntries(f, node)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, f := range nodeFingerprints {
+		node, err := m.store.readNode(f)
+		if err != nil {
+			return err
+		} else if node == nil {
+			continue
+		}
+
+		err = node.withEachEntry(func(entry *IndexEntry) error {
+			return m.removeLegacyThumbnail(entry)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fromVersion1 sets the bounds on the entries beneath each child node, and
+// counts the parents of each node.
+func (m *migration) fromVersion1() error {
+	var rootFingerprint Fingerprint
+
+	parentCounts := make(map[string]int)
+
+	err := m.walk(rootFingerprint, func(f Fingerprint, node *IndexNode) error {
+		for _, cf := range node.childFingerprints {
+			parentCounts[cf.String()]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	root, err := m.store.readNode(rootFingerprint)
+	if err != nil || root == nil {
+		return err
+	}
+
+	_, err = m.setChildBounds(rootFingerprint, root, parentCounts, make(map[string]*fingerprintBounds))
+	return err
+}
+
+// checkVersion0Options checks the options against the parameters every index
+// had before format version 1, so that nothing is written if they conflict.
+func (m *migration) checkVersion0Options() error {
+	index := m.index
+
+	if index.maxEntryDifference == 0 {
+		return invalidOptions("max entry difference must be specified to migrate an index without a manifest")
+	}
+	if index.thumbnailSizeMultiplier != 0 && index.thumbnailSizeMultiplier != defaultThumbnailSizeMultiplier {
+		return incompatibleIndex("index was created with thumbnail size multiplier %d but %d was requested", defaultThumbnailSizeMultiplier, index.thumbnailSizeMultiplier)
+	}
+	if index.minThumbnailSize != 0 {
+		return incompatibleIndex("index was created without a min thumbnail size but %d was requested", index.minThumbnailSize)
+	}
+	if index.fingerprintAlgorithm != nil && index.fingerprintAlgorithm.Name() != (LuminanceFingerprintAlgorithm{}).Name() {
+		return incompatibleIndex("index was created with fingerprint algorithm '%s' but '%s' was requested", (LuminanceFingerprintAlgorithm{}).Name(), index.fingerprintAlgorithm.Name())
+	}
+
+	return nil
+}
+
+// copyFile copies to a temporary file before moving it into place, so that
+// an interrupted copy is never mistaken for a complete one.
+func (m *migration) copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	err = os.MkdirAll(filepath.Dir(dest), os.FileMode(0700))
+	if err != nil {
+		return err
+	}
+
+	tempPath := dest + ".tmp"
+
+	out, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, dest)
+}
+
+func (m *migration) keyEntries(f Fingerprint, node *IndexNode) error {
+	m.report.NodesVisited++
+
+	if m.report.MaxFingerprintSize == 0 && len(node.entries) > 0 {
+		m.report.MaxFingerprintSize = node.entries[0].MaxFingerprint.Size()
+
+		requested := m.index.maxFingerprintSize
+		if requested != 0 && requested != m.report.MaxFingerprintSize {
+			return incompatibleIndex("index entries have max fingerprint size %d but %d was requested", m.report.MaxFingerprintSize, requested)
+		}
+	}
+
+	changed := false
+
+	for i, entry := range node.entries {
+		legacyPath := m.store.pathForThumbnail(&IndexEntry{MaxFingerprint: entry.MaxFingerprint})
+
+		if entry.Key == "" {
+			entry.Key = migratedEntryKey(f, i, entry)
+			m.report.EntriesKeyed++
+			changed = true
+		}
+
+		keyedPath := m.store.pathForThumbnail(entry)
+
+		// Copy rather than move, because entries with the same fingerprint
+		// shared the same thumbnail.
+		if _, err := os.Stat(keyedPath); os.IsNotExist(err) {
+			m.report.ThumbnailsCopied++
+
+			if !m.dryRun {
+				err = m.copyFile(legacyPath, keyedPath)
+				if err != nil {
+					return storeFailureForNode(f, err)
+				}
+			}
+		}
+
+		if !m.dryRun {
+			err := m.store.putEntryLocation(entry.Key, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if changed && !m.dryRun {
+		m.index.log().Debug("migrated node", "fingerprint", f.String(), "entries", len(node.entries))
+		return m.store.putNode(f, node)
+	}
+
+	return nil
+}
+
+func (m *migration) removeLegacyThumbnail(entry *IndexEntry) error {
+	legacyPath := m.store.pathForThumbnail(&IndexEntry{MaxFingerprint: entry.MaxFingerprint})
+
+	if _, err := os.Stat(legacyPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	m.report.ThumbnailsRemoved++
+
+	if m.dryRun {
+		return nil
+	}
+
+	err := os.Remove(legacyPath)
+	if err != nil && !os.IsNotExist(err) {
+		return storeFailure(err)
+	}
+
+	return nil
+}
+
+// setChildBounds sets the bounds of each of the node's children from the
+// entries beneath them, and returns the bounds of the entries beneath the node
+// itself (or nil if there are none). The bounds of nodes already done are
+// reused, since a node can have more than one parent.
+func (m *migration) setChildBounds(f Fingerprint, node *IndexNode, parentCounts map[string]int, done map[string]*fingerprintBounds) (*fingerprintBounds, error) {
+	var bounds *fingerprintBounds
+
+	include := func(entryFingerprint Fingerprint) {
+		if bounds == nil {
+			bounds = newFingerprintBounds(entryFingerprint)
+		} else {
+			bounds.expand(entryFingerprint)
+		}
+	}
+
+	for _, entry := range node.entries {
+		include(entry.MaxFingerprint)
+	}
+
+	childBounds := make(map[string]*fingerprintBounds)
+
+	for _, cf := range node.childFingerprints {
+		cb, ok := done[cf.String()]
+		if !ok {
+			child, err := m.store.readNode(cf)
+			if err != nil {
+				return nil, err
+			} else if child == nil {
+				return nil, corruptNode(cf, errMissingChild)
+			}
+
+			cb, err = m.setChildBounds(cf, child, parentCounts, done)
+			if err != nil {
+				return nil, err
+			}
+			done[cf.String()] = cb
+		}
+
+		if cb == nil {
+			continue
+		}
+
+		childBounds[cf.String()] = cb
+		include(cb.Min)
+		include(cb.Max)
+	}
+
+	m.report.ChildBoundsSet += len(childBounds)
+
+	if !m.dryRun {
+		node.childBounds = childBounds
+		node.parentCount = parentCounts[f.String()]
+
+		err := m.store.putNode(f, node)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return bounds, nil
+}
+
+// walk visits each node in the tree once, parents before their children.
+func (m *migration) walk(f Fingerprint, visit func(Fingerprint, *IndexNode) error) error {
+	return m.walkUnvisited(f, visit, make(map[string]bool))
+}
+
+func (m *migration) walkUnvisited(f Fingerprint, visit func(Fingerprint, *IndexNode) error, visited map[string]bool) error {
+	if visited[f.String()] {
+		return nil
+	}
+	visited[f.String()] = true
+
+	node, err := m.store.readNode(f)
+	if err != nil || node == nil {
+		return err
+	}
+
+	err = visit(f, node)
+	if err != nil {
+		return err
+	}
+
+	for _, cf := range node.childFingerprints {
+		err = m.walkUnvisited(cf, visit, visited)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *migration) writeManifest() error {
+	index := m.index
+
+	if index.maxFingerprintSize == 0 {
+		index.maxFingerprintSize = m.report.MaxFingerprintSize
+	}
+
+	index.applyDefaults()
+
+	err := index.validate()
+	if err != nil {
+		return err
+	}
+
+	m.report.ManifestWritten = true
+
+	if m.dryRun {
+		return nil
+	}
+
+	return m.store.PutManifest(context.Background(), index.manifest())
+}
+
+// migratedEntryKey derives a key for an entry from its position in the tree,
+// so that repeating an interrupted migration assigns the same keys.
+func migratedEntryKey(nodeFingerprint Fingerprint, position int, entry *IndexEntry) string {
+	keyHash := sha256.New()
+	keyHash.Write([]byte(nodeFingerprint.String()))
+	keyHash.Write([]byte(strconv.Itoa(position)))
+	keyHash.Write(entry.MaxFingerprint.Bytes())
+
+	return hex.EncodeToString(keyHash.Sum(nil))
+}
@@ -0,0 +1,374 @@
+package simian
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+
+	// createLegacyIndex creates an index in the layout used before format
+	// version 1, with unkeyed entries, thumbnails stored by fingerprint, no
+	// child bounds, and no manifest.
+	createLegacyIndex := func(t *testing.T, dir string) {
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		for i := 1; i <= 20; i++ {
+			_, err := index.Add(testImageWithSeed(i), map[string]interface{}{"seed": float64(i)})
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+		}
+		index.Close()
+
+		store, err := NewDiskIndexStore(dir)
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		defer store.Close()
+
+		m := &migration{store: store, index: &Index{}, report: &MigrationReport{}}
+
+		var rootFingerprint Fingerprint
+
+		err = m.walk(rootFingerprint, func(f Fingerprint, node *IndexNode) error {
+			for _, entry := range node.entries {
+				keyedPath := store.pathForThumbnail(entry)
+				legacyPath := store.pathForThumbnail(&IndexEntry{MaxFingerprint: entry.MaxFingerprint})
+
+				err := m.copyFile(keyedPath, legacyPath)
+				if err != nil {
+					return err
+				}
+				os.Remove(keyedPath)
+				store.removeEntryLocation(entry.Key, f)
+
+				entry.Key = ""
+			}
+			node.childBounds = nil
+			return store.putNode(f, node)
+		})
+		if err != nil {
+			t.Fatalf("Error downgrading index: %v", err)
+		}
+
+		os.Remove(path.Join(dir, manifestFileName))
+	}
+
+	// createVersion1Index creates an index in the layout used by format
+	// version 1, without child bounds.
+	createVersion1Index := func(t *testing.T, dir string) {
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		for i := 1; i <= 20; i++ {
+			_, err := index.Add(testImageWithSeed(i), nil)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+		}
+		index.Close()
+
+		store, err := NewDiskIndexStore(dir)
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		defer store.Close()
+
+		m := &migration{store: store, index: &Index{}, report: &MigrationReport{}}
+
+		var rootFingerprint Fingerprint
+
+		err = m.walk(rootFingerprint, func(f Fingerprint, node *IndexNode) error {
+			node.childBounds = nil
+			return store.putNode(f, node)
+		})
+		if err != nil {
+			t.Fatalf("Error downgrading index: %v", err)
+		}
+
+		manifest, err := store.GetManifest(context.Background())
+		if err != nil {
+			t.Fatalf("Error getting manifest: %v", err)
+		}
+		manifest.FormatVersion = 1
+		store.PutManifest(context.Background(), manifest)
+	}
+
+	withLegacyIndex := func(t *testing.T, action func(dir string)) {
+		dir := t.TempDir()
+
+		createLegacyIndex(t, dir)
+
+		action(dir)
+	}
+
+	expectManifest := func(t *testing.T, dir string) *IndexManifest {
+		store, err := NewDiskIndexStoreWithLockMode(dir, LockShared)
+		if err != nil {
+			t.Fatalf("Error opening store: %v", err)
+		}
+		defer store.Close()
+
+		manifest, err := store.GetManifest(context.Background())
+		if err != nil || manifest == nil {
+			t.Fatalf("Expected manifest but got %v, %v", manifest, err)
+		}
+		if manifest.FormatVersion != indexFormatVersion {
+			t.Errorf("Expected format version %d but got %d", indexFormatVersion, manifest.FormatVersion)
+		}
+
+		return manifest
+	}
+
+	expectBoundsSet := func(t *testing.T, dir string) {
+		store, err := NewMemoryIndexStoreFromDisk(dir)
+		if err != nil {
+			t.Fatalf("Error loading migrated index: %v", err)
+		}
+
+		for _, node := range store.nodes {
+			for _, cf := range node.childFingerprints {
+				if node.childBounds[cf.String()] == nil {
+					t.Fatalf("Expected bounds for child %s", cf)
+				}
+			}
+		}
+	}
+
+	expectMigrated := func(t *testing.T, dir string) map[string]bool {
+		store, err := NewMemoryIndexStoreFromDisk(dir)
+		if err != nil {
+			t.Fatalf("Error loading migrated index: %v", err)
+		}
+
+		index, err := NewIndex(dir, 0, 0)
+		if err != nil {
+			t.Fatalf("Error opening migrated index: %v", err)
+		}
+		defer index.Close()
+
+		keys := make(map[string]bool)
+
+		for key := range store.entryLocations {
+			entry, err := index.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if entry == nil || entry.Thumbnail == nil {
+				t.Fatalf("Expected entry with thumbnail for key '%s' but got %v", key, entry)
+			}
+
+			keys[key] = true
+		}
+
+		for i := 1; i <= 20; i++ {
+			results, err := index.FindNearest(testImageWithSeed(i), 1, 0.0)
+			if err != nil {
+				t.Fatalf("Error finding nearest: %v", err)
+			}
+			if len(results) != 1 || !keys[results[0].Key] {
+				t.Fatalf("Expected to find a migrated entry for image %d but got %v", i, results)
+			}
+		}
+
+		return keys
+	}
+
+	t.Run("should refuse to open an unmigrated index", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			_, err := NewIndex(dir, 8, 0.05)
+			if !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("Expected ErrUnsupportedFormat but got %v", err)
+			}
+		})
+	})
+
+	t.Run("should upgrade an index without a manifest", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			report, err := Migrate(dir, false, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+
+			if report.FromVersion != 0 || report.ToVersion != indexFormatVersion {
+				t.Errorf("Expected migration from 0 to %d but got %d to %d", indexFormatVersion, report.FromVersion, report.ToVersion)
+			}
+			if report.EntriesKeyed != 20 {
+				t.Errorf("Expected 20 entries to be keyed but got %d", report.EntriesKeyed)
+			}
+			if report.MaxFingerprintSize != 8 {
+				t.Errorf("Expected max fingerprint size 8 but got %d", report.MaxFingerprintSize)
+			}
+
+			keys := expectMigrated(t, dir)
+			if len(keys) != 20 {
+				t.Errorf("Expected 20 distinct keys but got %d", len(keys))
+			}
+			expectBoundsSet(t, dir)
+		})
+	})
+
+	t.Run("should set child bounds for a version 1 index", func(t *testing.T) {
+		dir := t.TempDir()
+
+		createVersion1Index(t, dir)
+
+		_, err := NewIndex(dir, 0, 0)
+		if !errors.Is(err, ErrUnsupportedFormat) {
+			t.Fatalf("Expected ErrUnsupportedFormat but got %v", err)
+		}
+
+		report, err := Migrate(dir, false)
+		if err != nil {
+			t.Fatalf("Error migrating: %v", err)
+		}
+		if report.FromVersion != 1 || report.EntriesKeyed != 0 || report.ChildBoundsSet == 0 {
+			t.Errorf("Expected only child bounds to be set but got %+v", report)
+		}
+
+		manifest := expectManifest(t, dir)
+		if manifest.MaxEntryDifference != 0.05 {
+			t.Errorf("Expected max entry difference to be kept but got %v", manifest.MaxEntryDifference)
+		}
+
+		expectBoundsSet(t, dir)
+		expectMigrated(t, dir)
+	})
+
+	t.Run("should make no changes for a dry run", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			report, err := Migrate(dir, true, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+
+			if report.EntriesKeyed != 20 || report.ThumbnailsCopied != 20 || !report.ManifestWritten {
+				t.Errorf("Expected report of changes but got %+v", report)
+			}
+
+			if _, err := os.Stat(path.Join(dir, manifestFileName)); !os.IsNotExist(err) {
+				t.Errorf("Expected no manifest to be written but got %v", err)
+			}
+
+			_, err = NewIndex(dir, 8, 0.05)
+			if !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("Expected index to remain unmigrated but got %v", err)
+			}
+		})
+	})
+
+	t.Run("should create nothing for a dry run", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			for _, name := range []string{nodeEntriesDir, attributeIndexDir} {
+				err := os.RemoveAll(path.Join(dir, name))
+				if err != nil {
+					t.Fatalf("Error removing %s: %v", name, err)
+				}
+			}
+
+			listDir := func() []string {
+				files, err := ioutil.ReadDir(dir)
+				if err != nil {
+					t.Fatalf("Error listing directory: %v", err)
+				}
+				var names []string
+				for _, f := range files {
+					names = append(names, f.Name())
+				}
+				return names
+			}
+
+			before := listDir()
+
+			_, err := Migrate(dir, true, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+
+			after := listDir()
+			if !reflect.DeepEqual(before, after) {
+				t.Errorf("Expected directory to contain %v but got %v", before, after)
+			}
+		})
+	})
+
+	t.Run("should resume an interrupted migration with the same keys", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			_, err := Migrate(dir, false, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+			keys := expectMigrated(t, dir)
+
+			// Simulate an interruption before the manifest was written
+			os.Remove(path.Join(dir, manifestFileName))
+
+			report, err := Migrate(dir, false, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error resuming migration: %v", err)
+			}
+			if report.EntriesKeyed != 0 {
+				t.Errorf("Expected no entries to need keys but got %d", report.EntriesKeyed)
+			}
+
+			resumedKeys := expectMigrated(t, dir)
+			for key := range keys {
+				if !resumedKeys[key] {
+					t.Errorf("Expected key '%s' to be preserved", key)
+				}
+			}
+		})
+	})
+
+	t.Run("should do nothing for a current index", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			_, err := Migrate(dir, false, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+
+			report, err := Migrate(dir, false)
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+			if report.FromVersion != indexFormatVersion || report.NodesVisited != 0 {
+				t.Errorf("Expected nothing to be migrated but got %+v", report)
+			}
+		})
+	})
+
+	t.Run("should require the max entry difference", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			_, err := Migrate(dir, false)
+			if !errors.Is(err, ErrInvalidOptions) {
+				t.Errorf("Expected ErrInvalidOptions but got %v", err)
+			}
+		})
+	})
+
+	t.Run("should reject a mismatched max fingerprint size before changing anything", func(t *testing.T) {
+		withLegacyIndex(t, func(dir string) {
+			_, err := Migrate(dir, false, WithMaxEntryDifference(0.05), WithMaxFingerprintSize(12))
+			if !errors.Is(err, ErrIncompatibleIndex) {
+				t.Fatalf("Expected ErrIncompatibleIndex but got %v", err)
+			}
+
+			report, err := Migrate(dir, true, WithMaxEntryDifference(0.05))
+			if err != nil {
+				t.Fatalf("Error migrating: %v", err)
+			}
+			if report.EntriesKeyed != 20 {
+				t.Errorf("Expected all entries to remain unkeyed but %d need keys", report.EntriesKeyed)
+			}
+		})
+	})
+}
@@ -0,0 +1,107 @@
+package simian
+
+import (
+	"container/heap"
+)
+
+// nodeCandidate is a node waiting to be searched, along with the smallest
+// difference any entry beneath it can have to the image being searched for.
+// Nodes are only loaded once they are taken from the queue, so that nodes
+// which are ruled out are never read.
+type nodeCandidate struct {
+	node                 *IndexNode
+	parent               *IndexNode
+	fingerprint          Fingerprint
+	childFingerprintSize int
+	lowerBound           float64
+}
+
+// nodeCandidateQueue orders candidates so that the one which could hold the
+// nearest entry is searched first.
+type nodeCandidateQueue []nodeCandidate
+
+func (q nodeCandidateQueue) Len() int {
+	return len(q)
+}
+
+func (q nodeCandidateQueue) Less(i, j int) bool {
+	return q[i].lowerBound < q[j].lowerBound
+}
+
+func (q nodeCandidateQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *nodeCandidateQueue) Push(x interface{}) {
+	*q = append(*q, x.(nodeCandidate))
+}
+
+func (q *nodeCandidateQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// searchResultHeap keeps the nearest results found so far, with the furthest
+// of them on top so that it can be replaced when a nearer one is found.
+type searchResultHeap struct {
+	results       []SearchResult
+	maxResults    int
+	maxDifference float64
+	options       *searchOptions
+}
+
+// accepts reports whether an entry with the given difference would be among
+// the results.
+func (h *searchResultHeap) accepts(difference float64) bool {
+	if difference > h.maxDifference {
+		return false
+	}
+	if len(h.results) < h.maxResults {
+		return true
+	}
+	return len(h.results) > 0 && difference < h.results[0].Difference
+}
+
+func (h *searchResultHeap) add(result SearchResult) {
+	heap.Push(h, result)
+	if len(h.results) > h.maxResults {
+		heap.Pop(h)
+	}
+}
+
+// sorted empties the heap, returning its results nearest first. Each result
+// has a copy of its entry, so that callers can't modify stored entries.
+func (h *searchResultHeap) sorted() []SearchResult {
+	sorted := make([]SearchResult, len(h.results))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		result := heap.Pop(h).(SearchResult)
+		result.Entry = result.Entry.copy()
+		sorted[i] = result
+	}
+	return sorted
+}
+
+func (h *searchResultHeap) Len() int {
+	return len(h.results)
+}
+
+func (h *searchResultHeap) Less(i, j int) bool {
+	return h.results[i].Difference > h.results[j].Difference
+}
+
+func (h *searchResultHeap) Swap(i, j int) {
+	h.results[i], h.results[j] = h.results[j], h.results[i]
+}
+
+func (h *searchResultHeap) Push(x interface{}) {
+	h.results = append(h.results, x.(SearchResult))
+}
+
+func (h *searchResultHeap) Pop() interface{} {
+	old := h.results
+	r := old[len(old)-1]
+	h.results = old[:len(old)-1]
+	return r
+}
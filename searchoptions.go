@@ -0,0 +1,98 @@
+package simian
+
+// SearchOption configures a single search.
+type SearchOption func(*searchOptions)
+
+// SearchStats describes how a search went. If the search was Truncated, it
+// stopped before it could be sure of having found the best results, and the
+// results are the best of those it did find.
+type SearchStats struct {
+	NodesVisited    int
+	EntriesCompared int
+	Truncated       bool
+}
+
+type searchOptions struct {
+	excludedKeys    map[string]bool
+	filters         []AttributeFilter
+	maxNodesVisited int
+	stats           *SearchStats
+	trace           *SearchTrace
+}
+
+// canVisit reports whether the search is allowed to visit another node.
+func (o *searchOptions) canVisit() bool {
+	return o.maxNodesVisited <= 0 || o.stats.NodesVisited < o.maxNodesVisited
+}
+
+// includes reports whether the given entry may be among the results.
+func (o *searchOptions) includes(entry *IndexEntry) bool {
+	if o.excludedKeys[entry.Key] {
+		return false
+	}
+	for _, filter := range o.filters {
+		if !filter(entry.Attributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// ExcludingKeys leaves the entries with the given keys out of the results,
+// such as the entry being searched from by SearchByKey.
+func ExcludingKeys(keys ...string) SearchOption {
+	return func(o *searchOptions) {
+		if o.excludedKeys == nil {
+			o.excludedKeys = make(map[string]bool)
+		}
+		for _, key := range keys {
+			o.excludedKeys[key] = true
+		}
+	}
+}
+
+// LimitingNodesVisited stops a search once it has visited the given number of
+// nodes, trading accuracy for a bounded amount of work. Each node visited
+// after the root is loaded from the store. Use RecordingStats to find out
+// whether the limit was reached.
+func LimitingNodesVisited(nodes int) SearchOption {
+	return func(o *searchOptions) {
+		o.maxNodesVisited = nodes
+	}
+}
+
+// MatchingAttributes leaves out of the results any entries whose attributes
+// don't match all of the given filters. Entries left out don't count towards
+// the maximum number of results, so a search still returns as many results
+// as it can find which match.
+func MatchingAttributes(filters ...AttributeFilter) SearchOption {
+	return func(o *searchOptions) {
+		o.filters = append(o.filters, filters...)
+	}
+}
+
+// RecordingStats fills in the given stats once the search is done.
+func RecordingStats(stats *SearchStats) SearchOption {
+	return func(o *searchOptions) {
+		o.stats = stats
+	}
+}
+
+func newSearchOptions(options []SearchOption) *searchOptions {
+	o := &searchOptions{}
+	for _, option := range options {
+		option(o)
+	}
+
+	if o.stats == nil {
+		o.stats = &SearchStats{}
+	} else {
+		*o.stats = SearchStats{}
+	}
+
+	if o.trace != nil {
+		*o.trace = SearchTrace{}
+	}
+
+	return o
+}
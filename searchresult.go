@@ -0,0 +1,25 @@
+package simian
+
+// SearchResult is an entry found by a search, along with how different it is
+// to the image being searched for and where in the index it was found.
+type SearchResult struct {
+	Entry           *IndexEntry
+	Key             string
+	Difference      float64
+	Depth           int
+	NodeFingerprint Fingerprint
+}
+
+// resultEntries returns the entries of search results, passing on any error.
+func resultEntries(results []SearchResult, err error) ([]*IndexEntry, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*IndexEntry, len(results))
+	for j, result := range results {
+		entries[j] = result.Entry
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,118 @@
+package simian
+
+// Reasons a traced search ended.
+const (
+	// SearchBounded means no unsearched node could hold an entry nearer than
+	// the results found.
+	SearchBounded = "bounded"
+
+	// SearchExhausted means every node which could hold a result was searched.
+	SearchExhausted = "exhausted"
+
+	// SearchFailed means the search returned an error.
+	SearchFailed = "failed"
+
+	// SearchNodeLimitReached means the search visited as many nodes as it was
+	// limited to.
+	SearchNodeLimitReached = "nodeLimitReached"
+
+	// SearchStopped means the function given to FindWithin returned false.
+	SearchStopped = "stopped"
+)
+
+// Outcomes of comparing an entry during a traced search.
+const (
+	EntryExcluded = "excluded"
+	EntryFound    = "found"
+	EntrySkipped  = "skipped"
+)
+
+// SearchTrace records what a search did, to help explain why an entry was or
+// wasn't among its results. It can be marshalled to JSON.
+type SearchTrace struct {
+	Nodes       []TracedNode       `json:"nodes"`
+	Comparisons []TracedComparison `json:"comparisons"`
+	Pruned      []TracedPrune      `json:"pruned"`
+	EndReason   string             `json:"endReason"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// TracedNode is a node visited by a search, in the order visited.
+type TracedNode struct {
+	Fingerprint string  `json:"fingerprint"`
+	Depth       int     `json:"depth"`
+	Children    int     `json:"children"`
+	Entries     int     `json:"entries"`
+	LowerBound  float64 `json:"lowerBound"`
+}
+
+// TracedComparison is an entry compared by a search, and whether it was found,
+// skipped for being too different, or excluded by an option.
+type TracedComparison struct {
+	Key             string  `json:"key"`
+	NodeFingerprint string  `json:"nodeFingerprint"`
+	Difference      float64 `json:"difference"`
+	Outcome         string  `json:"outcome"`
+}
+
+// TracedPrune is a child which a search didn't visit because no entry beneath
+// it could be near enough.
+type TracedPrune struct {
+	Fingerprint       string  `json:"fingerprint"`
+	ParentFingerprint string  `json:"parentFingerprint"`
+	LowerBound        float64 `json:"lowerBound"`
+}
+
+// Tracing records what the search does in the given trace, replacing anything
+// already in it.
+func Tracing(trace *SearchTrace) SearchOption {
+	return func(o *searchOptions) {
+		o.trace = trace
+	}
+}
+
+func (o *searchOptions) traceComparison(entry *IndexEntry, nodeFingerprint Fingerprint, difference float64, outcome string) {
+	if o.trace == nil {
+		return
+	}
+	o.trace.Comparisons = append(o.trace.Comparisons, TracedComparison{
+		Key:             entry.Key,
+		NodeFingerprint: nodeFingerprint.String(),
+		Difference:      difference,
+		Outcome:         outcome,
+	})
+}
+
+func (o *searchOptions) traceEnd(reason string, err error) {
+	if o.trace == nil {
+		return
+	}
+	o.trace.EndReason = reason
+	if err != nil {
+		o.trace.Error = err.Error()
+	}
+}
+
+func (o *searchOptions) traceNode(f Fingerprint, childFingerprintSize int, node *IndexNode, lowerBound float64) {
+	if o.trace == nil {
+		return
+	}
+	o.trace.Nodes = append(o.trace.Nodes, TracedNode{
+		Fingerprint: f.String(),
+		Depth:       nodeDepth(childFingerprintSize),
+		Children:    len(node.childFingerprints),
+		Entries:     len(node.entries),
+		LowerBound:  lowerBound,
+	})
+}
+
+func (o *searchOptions) tracePrune(f Fingerprint, parentFingerprint Fingerprint, lowerBound float64) {
+	if o.trace == nil {
+		return
+	}
+	o.trace.Pruned = append(o.trace.Pruned, TracedPrune{
+		Fingerprint:       f.String(),
+		ParentFingerprint: parentFingerprint.String(),
+		LowerBound:        lowerBound,
+	})
+}
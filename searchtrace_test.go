@@ -0,0 +1,161 @@
+package simian
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+func TestSearchTrace(t *testing.T) {
+
+	withPopulatedIndex := func(t *testing.T, action func(index *Index, keys []string)) {
+		index, err := NewMemoryIndex(8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+
+		var keys []string
+
+		random := rand.New(rand.NewSource(1))
+		for i := 0; i < 50; i++ {
+			key, err := index.Add(randomTestImage(random), nil)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+			keys = append(keys, key)
+		}
+
+		action(index, keys)
+	}
+
+	t.Run("should record nodes visited and entries compared", func(t *testing.T) {
+		withPopulatedIndex(t, func(index *Index, keys []string) {
+			var trace SearchTrace
+			var stats SearchStats
+
+			results, err := index.SearchByKey(keys[0], 5, 1.0, ExcludingKeys(keys[0]), Tracing(&trace), RecordingStats(&stats))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+
+			if len(trace.Nodes) != stats.NodesVisited {
+				t.Errorf("Expected %d traced nodes but got %d", stats.NodesVisited, len(trace.Nodes))
+			}
+			if trace.Nodes[0].Fingerprint != "" || trace.Nodes[0].Depth != 0 {
+				t.Errorf("Expected the root to be visited first but got %+v", trace.Nodes[0])
+			}
+			if trace.EndReason != SearchBounded && trace.EndReason != SearchExhausted {
+				t.Errorf("Expected search to end normally but got '%s'", trace.EndReason)
+			}
+
+			outcomes := make(map[string]string)
+			for _, c := range trace.Comparisons {
+				outcomes[c.Key] = c.Outcome
+			}
+
+			if outcomes[keys[0]] != EntryExcluded {
+				t.Errorf("Expected the query entry to be traced as excluded but got '%s'", outcomes[keys[0]])
+			}
+			for _, result := range results {
+				if outcomes[result.Key] != EntryFound {
+					t.Errorf("Expected result '%s' to be traced as found but got '%s'", result.Key, outcomes[result.Key])
+				}
+			}
+		})
+	})
+
+	t.Run("should record children pruned by their bounds", func(t *testing.T) {
+		withPopulatedIndex(t, func(index *Index, keys []string) {
+			var trace SearchTrace
+
+			err := index.FindWithin(randomTestImage(rand.New(rand.NewSource(2))), 0.01, func(SearchResult) bool { return true }, Tracing(&trace))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+
+			if len(trace.Pruned) == 0 {
+				t.Errorf("Expected pruned children to be traced")
+			}
+			for _, p := range trace.Pruned {
+				if p.LowerBound <= 0.01 {
+					t.Errorf("Expected pruned child to have a lower bound above the max difference but got %v", p.LowerBound)
+				}
+			}
+			if trace.EndReason != SearchExhausted {
+				t.Errorf("Expected range search to end exhausted but got '%s'", trace.EndReason)
+			}
+		})
+	})
+
+	t.Run("should record why a search ended early", func(t *testing.T) {
+		withPopulatedIndex(t, func(index *Index, keys []string) {
+			var trace SearchTrace
+
+			_, err := index.SearchByKey(keys[0], 50, 1.0, LimitingNodesVisited(2), Tracing(&trace))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if trace.EndReason != SearchNodeLimitReached {
+				t.Errorf("Expected '%s' but got '%s'", SearchNodeLimitReached, trace.EndReason)
+			}
+
+			err = index.FindWithin(testImageWithSeed(1), 1.0, func(SearchResult) bool { return false }, Tracing(&trace))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if trace.EndReason != SearchStopped {
+				t.Errorf("Expected '%s' but got '%s'", SearchStopped, trace.EndReason)
+			}
+		})
+	})
+
+	t.Run("should record a failed search", func(t *testing.T) {
+		dir := t.TempDir()
+
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		defer index.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var trace SearchTrace
+
+		_, err = index.SearchContext(ctx, testImageWithSeed(1), 1, 0.0, Tracing(&trace))
+		if err != context.Canceled {
+			t.Fatalf("Expected context.Canceled but got %v", err)
+		}
+		if trace.EndReason != SearchFailed || trace.Error != context.Canceled.Error() {
+			t.Errorf("Expected failure to be traced but got '%s' with error '%s'", trace.EndReason, trace.Error)
+		}
+	})
+
+	t.Run("should be exportable as JSON", func(t *testing.T) {
+		withPopulatedIndex(t, func(index *Index, keys []string) {
+			var trace SearchTrace
+
+			_, err := index.SearchByKey(keys[0], 5, 1.0, Tracing(&trace))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+
+			jsonBytes, err := json.Marshal(&trace)
+			if err != nil {
+				t.Fatalf("Error marshalling trace: %v", err)
+			}
+
+			var result SearchTrace
+			err = json.Unmarshal(jsonBytes, &result)
+			if err != nil {
+				t.Fatalf("Error unmarshalling trace: %v", err)
+			}
+
+			if len(result.Nodes) != len(trace.Nodes) || len(result.Comparisons) != len(trace.Comparisons) || result.EndReason != trace.EndReason {
+				t.Errorf("Expected trace to roundtrip but got %+v", result)
+			}
+		})
+	})
+}
@@ -0,0 +1,125 @@
+package simian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+)
+
+// TypedIndex stores the attributes of entries as values of type T instead of
+// maps, so that callers get back the types they put in rather than the
+// float64s and maps which attributes become once stored as JSON.
+//
+// T must marshal to a JSON object, such as a struct or a map. Its fields are
+// stored as ordinary attributes, so the map form of the same entries remains
+// available through the underlying Index, and works with attribute filters
+// and attribute indexing.
+type TypedIndex[T any] struct {
+	Index *Index
+}
+
+func (t *TypedIndex[T]) Add(image image.Image, attributes T) (key string, err error) {
+	return t.AddContext(context.Background(), image, attributes)
+}
+
+func (t *TypedIndex[T]) AddContext(ctx context.Context, image image.Image, attributes T) (key string, err error) {
+	encoded, err := EncodeAttributes(attributes)
+	if err != nil {
+		return "", err
+	}
+
+	return t.Index.AddContext(ctx, image, encoded)
+}
+
+// Attributes decodes the attributes of an entry, such as one from a search
+// result.
+func (t *TypedIndex[T]) Attributes(entry *IndexEntry) (T, error) {
+	return DecodeAttributes[T](entry.Attributes)
+}
+
+// Get returns the entry with the given key and its decoded attributes, or a
+// nil entry if there isn't one.
+func (t *TypedIndex[T]) Get(key string) (*IndexEntry, T, error) {
+	return t.GetContext(context.Background(), key)
+}
+
+func (t *TypedIndex[T]) GetContext(ctx context.Context, key string) (*IndexEntry, T, error) {
+	var attributes T
+
+	entry, err := t.Index.GetContext(ctx, key)
+	if err != nil || entry == nil {
+		return nil, attributes, err
+	}
+
+	attributes, err = t.Attributes(entry)
+	if err != nil {
+		return nil, attributes, err
+	}
+
+	return entry, attributes, nil
+}
+
+func (t *TypedIndex[T]) ReplaceAttributes(key string, attributes T) error {
+	return t.ReplaceAttributesContext(context.Background(), key, attributes)
+}
+
+func (t *TypedIndex[T]) ReplaceAttributesContext(ctx context.Context, key string, attributes T) error {
+	encoded, err := EncodeAttributes(attributes)
+	if err != nil {
+		return err
+	}
+
+	return t.Index.ReplaceAttributesContext(ctx, key, encoded)
+}
+
+// DecodeAttributes converts attributes in map form to a value of type T, the
+// same way as JSON is unmarshalled.
+func DecodeAttributes[T any](attributes map[string]interface{}) (T, error) {
+	var value T
+
+	if attributes == nil {
+		return value, nil
+	}
+
+	attributeBytes, err := json.Marshal(attributes)
+	if err != nil {
+		return value, &kindError{kind: ErrInvalidAttributes, err: err}
+	}
+
+	err = json.Unmarshal(attributeBytes, &value)
+	if err != nil {
+		return value, &kindError{kind: ErrInvalidAttributes, err: err}
+	}
+
+	return value, nil
+}
+
+// EncodeAttributes converts a value to attributes in map form, the same way
+// as they would be once stored as JSON. Numbers become float64s, except for
+// integers too large for a float64 to hold exactly, which become json.Numbers.
+// ErrInvalidAttributes is returned if the value doesn't marshal to a JSON
+// object or null.
+func EncodeAttributes(value interface{}) (map[string]interface{}, error) {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, &kindError{kind: ErrInvalidAttributes, err: err}
+	}
+
+	if bytes.Equal(valueBytes, []byte("null")) {
+		return nil, nil
+	}
+
+	var attributes map[string]interface{}
+	err = decodeJSONNumbers(valueBytes, &attributes)
+	if err != nil {
+		return nil, &kindError{kind: ErrInvalidAttributes, err: err}
+	}
+
+	return exactAttributeNumbers(attributes), nil
+}
+
+// NewTypedIndex wraps the given index to store attributes of type T.
+func NewTypedIndex[T any](index *Index) *TypedIndex[T] {
+	return &TypedIndex[T]{Index: index}
+}
@@ -0,0 +1,188 @@
+package simian
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type testAttributes struct {
+	Source string         `json:"source"`
+	Count  int            `json:"count"`
+	Size   testDimensions `json:"size"`
+	Tags   []string       `json:"tags,omitempty"`
+}
+
+type testDimensions struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func TestTypedIndex(t *testing.T) {
+
+	withTypedIndex := func(t *testing.T, action func(index *TypedIndex[testAttributes], dir string)) {
+		dir := t.TempDir()
+
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		defer index.Close()
+
+		action(NewTypedIndex[testAttributes](index), dir)
+	}
+
+	attributes := testAttributes{
+		Source: "upload-42",
+		Count:  3,
+		Size:   testDimensions{Width: 640, Height: 480},
+		Tags:   []string{"cat"},
+	}
+
+	t.Run("should return attributes with their original types", func(t *testing.T) {
+		withTypedIndex(t, func(index *TypedIndex[testAttributes], dir string) {
+			key, err := index.Add(testImageWithSeed(1), attributes)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+
+			entry, result, err := index.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if entry == nil || entry.Key != key {
+				t.Fatalf("Expected entry '%s' but got %v", key, entry)
+			}
+			if !reflect.DeepEqual(result, attributes) {
+				t.Errorf("Expected %+v but got %+v", attributes, result)
+			}
+		})
+	})
+
+	t.Run("should keep the map form available", func(t *testing.T) {
+		withTypedIndex(t, func(index *TypedIndex[testAttributes], dir string) {
+			key, err := index.Add(testImageWithSeed(1), attributes)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+
+			err = index.Index.UpdateAttributes(key, map[string]interface{}{"count": 4})
+			if err != nil {
+				t.Fatalf("Error updating attributes: %v", err)
+			}
+
+			results, err := index.Index.Search(testImageWithSeed(1), 1, 0.0, MatchingAttributes(AttributeEquals("source", "upload-42")))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if len(results) != 1 {
+				t.Fatalf("Expected 1 result but got %d", len(results))
+			}
+
+			result, err := index.Attributes(results[0].Entry)
+			if err != nil {
+				t.Fatalf("Error decoding attributes: %v", err)
+			}
+			if result.Count != 4 || result.Size != attributes.Size {
+				t.Errorf("Expected updated attributes but got %+v", result)
+			}
+		})
+	})
+
+	t.Run("should replace attributes", func(t *testing.T) {
+		withTypedIndex(t, func(index *TypedIndex[testAttributes], dir string) {
+			key, err := index.Add(testImageWithSeed(1), attributes)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+
+			replacement := testAttributes{Source: "import"}
+			err = index.ReplaceAttributes(key, replacement)
+			if err != nil {
+				t.Fatalf("Error replacing attributes: %v", err)
+			}
+
+			_, result, err := index.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if !reflect.DeepEqual(result, replacement) {
+				t.Errorf("Expected %+v but got %+v", replacement, result)
+			}
+		})
+	})
+
+	t.Run("should return a nil entry for an unknown key", func(t *testing.T) {
+		withTypedIndex(t, func(index *TypedIndex[testAttributes], dir string) {
+			entry, result, err := index.Get("nonexistent")
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if entry != nil || !reflect.DeepEqual(result, testAttributes{}) {
+				t.Errorf("Expected nothing but got %v with %+v", entry, result)
+			}
+		})
+	})
+
+	t.Run("should keep large integers exact", func(t *testing.T) {
+		type largeAttributes struct {
+			ID int64 `json:"id"`
+		}
+		attributes := largeAttributes{ID: 1<<60 + 1}
+
+		check := func(t *testing.T, index *Index) {
+			typedIndex := NewTypedIndex[largeAttributes](index)
+
+			key, err := typedIndex.Add(testImageWithSeed(1), attributes)
+			if err != nil {
+				t.Fatalf("Error adding entry: %v", err)
+			}
+
+			_, result, err := typedIndex.Get(key)
+			if err != nil {
+				t.Fatalf("Error getting entry: %v", err)
+			}
+			if result != attributes {
+				t.Errorf("Expected %+v but got %+v", attributes, result)
+			}
+
+			results, err := index.Search(testImageWithSeed(1), 1, 0.0, MatchingAttributes(AttributeEquals("id", int64(1<<60))))
+			if err != nil {
+				t.Fatalf("Error searching: %v", err)
+			}
+			if len(results) != 0 {
+				t.Errorf("Expected no results for a nearby integer but got %d", len(results))
+			}
+		}
+
+		t.Run("in a disk index", func(t *testing.T) {
+			withTypedIndex(t, func(index *TypedIndex[testAttributes], dir string) {
+				check(t, index.Index)
+			})
+		})
+
+		t.Run("in a memory index", func(t *testing.T) {
+			index, err := NewMemoryIndex(8, 0.05)
+			if err != nil {
+				t.Fatalf("Error creating index: %v", err)
+			}
+
+			check(t, index)
+		})
+	})
+
+	t.Run("should reject attributes which aren't a JSON object", func(t *testing.T) {
+		dir := t.TempDir()
+
+		index, err := NewIndex(dir, 8, 0.05)
+		if err != nil {
+			t.Fatalf("Error creating index: %v", err)
+		}
+		defer index.Close()
+
+		_, err = NewTypedIndex[[]string](index).Add(testImageWithSeed(1), []string{"cat"})
+		if !errors.Is(err, ErrInvalidAttributes) {
+			t.Errorf("Expected ErrInvalidAttributes but got %v", err)
+		}
+	})
+}